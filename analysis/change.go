@@ -0,0 +1,252 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/pkg/errors"
+)
+
+// signals telling which output of a tx is the change back to the sender
+const (
+	SignalFresh    = "fresh"             // change address appears first in this tx
+	SignalType     = "address_type"      // change address is of the same type as the inputs
+	SignalNonRound = "non_round"         // payments are round, change is what is left
+	SignalInput    = "unnecessary_input" // every input is needed if this output is change
+)
+
+// values which are multiples of this are round, 0.0001 BTC
+const roundValue = 10000
+
+// ChangeOptions scores signals, a signal with weight 0 is off. An output
+// is change if its score reaches Threshold and no other output scores as
+// high.
+type ChangeOptions struct {
+	Weights   map[string]float64
+	Threshold float64
+}
+
+func DefaultChangeOptions() ChangeOptions {
+	return ChangeOptions{
+		Weights: map[string]float64{
+			SignalFresh:    1,
+			SignalType:     1,
+			SignalNonRound: 0.5,
+			SignalInput:    1,
+		},
+		Threshold: 1.5,
+	}
+}
+
+// ParseChangeSignals reads `name[=weight]` items given by `--change-signals`,
+// signals not given are off. A signal without weight has its default one.
+func ParseChangeSignals(items []string, threshold float64) (ChangeOptions, error) {
+	opts := ChangeOptions{Weights: make(map[string]float64), Threshold: threshold}
+	defaults := DefaultChangeOptions().Weights
+	for _, item := range items {
+		name, value := item, ""
+		if i := strings.Index(item, "="); i >= 0 {
+			name, value = item[:i], item[i+1:]
+		}
+		weight, ok := defaults[name]
+		if !ok {
+			return opts, errors.New(fmt.Sprintf("unknown change signal `%s`, should be one of fresh, address_type, non_round, unnecessary_input", name))
+		}
+		if value != "" {
+			w, err := strconv.ParseFloat(value, 64)
+			if err != nil || w < 0 {
+				return opts, errors.New(fmt.Sprintf("invalid weight in change signal `%s`", item))
+			}
+			weight = w
+		}
+		opts.Weights[name] = weight
+	}
+	return opts, nil
+}
+
+// ChangeResult is the change output found in a tx and why.
+type ChangeResult struct {
+	Txid    string       `json:"txid"`
+	Index   int          `json:"index"`
+	Address string       `json:"address"`
+	Value   chain.Amount `json:"value"`
+	Score   float64      `json:"score"`
+	Signals []string     `json:"signals"`
+}
+
+func (r ChangeResult) String() string {
+	return fmt.Sprintf("%s:%d %s (%s), score %.2f by %s", r.Txid, r.Index, r.Address, r.Value, r.Score, strings.Join(r.Signals, ", "))
+}
+
+// position of a tx in the chain
+type txPos struct {
+	height   uint
+	position uint
+}
+
+func (p txPos) before(q txPos) bool {
+	return p.height < q.height || p.height == q.height && p.position < q.position
+}
+
+// ChangeDetector finds change outputs of txs. It knows where every
+// address of the dataset appears first to tell fresh addresses, and keeps
+// the change outputs used to link addresses for the cluster report.
+type ChangeDetector struct {
+	opts      ChangeOptions
+	firstSeen map[string]txPos
+
+	mu    sync.Mutex
+	links map[string]ChangeResult // by txid
+}
+
+func NewChangeDetector(txs []chain.Transaction, opts ChangeOptions) *ChangeDetector {
+	d := &ChangeDetector{
+		opts:      opts,
+		firstSeen: make(map[string]txPos),
+		links:     make(map[string]ChangeResult),
+	}
+	if opts.Weights[SignalFresh] > 0 {
+		for i := range txs {
+			tx := &txs[i]
+			pos := txPos{tx.Block.Height, tx.Block.Position}
+			for _, addr := range append(tx.InputAddresses(), tx.OutputAddresses()...) {
+				if first, ok := d.firstSeen[addr]; !ok || pos.before(first) {
+					d.firstSeen[addr] = pos
+				}
+			}
+		}
+	}
+	return d
+}
+
+// seenBefore marks addr as seen before every tx of the detector, so it is
+// not fresh. The cluster db uses it for addresses of earlier blocks.
+func (d *ChangeDetector) seenBefore(addr string) {
+	d.firstSeen[addr] = txPos{}
+}
+
+// AddressType is p2pkh, p2sh, p2wpkh, p2wsh, p2tr or other.
+func AddressType(addr string) string {
+	switch {
+	case strings.HasPrefix(addr, "1"):
+		return "p2pkh"
+	case strings.HasPrefix(addr, "3"):
+		return "p2sh"
+	case strings.HasPrefix(addr, "bc1q") && len(addr) == 42:
+		return "p2wpkh"
+	case strings.HasPrefix(addr, "bc1q") && len(addr) == 62:
+		return "p2wsh"
+	case strings.HasPrefix(addr, "bc1p"):
+		return "p2tr"
+	}
+	return "other"
+}
+
+// signals returns outputs each enabled signal fires for
+func (d *ChangeDetector) signals(tx *chain.Transaction) map[string][]int {
+	fired := make(map[string][]int)
+	on := func(signal string) bool { return d.opts.Weights[signal] > 0 }
+	pos := txPos{tx.Block.Height, tx.Block.Position}
+	// all inputs of one address type
+	inType := ""
+	inAddrs := make(map[string]bool, len(tx.Inputs))
+	for _, in := range tx.Inputs {
+		inAddrs[in.Address] = true
+		t := AddressType(in.Address)
+		if inType != "" && t != inType {
+			inType = "other"
+		} else {
+			inType = t
+		}
+	}
+	totalIn, errIn := tx.TotalIn()
+	totalOut, errOut := tx.TotalOut()
+	fee, errFee := tx.ComputedFee()
+	minIn := tx.Inputs[0].Value
+	for _, in := range tx.Inputs {
+		if in.Value < minIn {
+			minIn = in.Value
+		}
+	}
+	for i, out := range tx.Outputs {
+		if out.Address == "" {
+			continue
+		}
+		// an address paid back to its input is seen by this tx already
+		if on(SignalFresh) && !inAddrs[out.Address] && d.firstSeen[out.Address] == pos {
+			fired[SignalFresh] = append(fired[SignalFresh], i)
+		}
+		if on(SignalType) && inType != "other" && AddressType(out.Address) == inType {
+			fired[SignalType] = append(fired[SignalType], i)
+		}
+		if on(SignalNonRound) && out.Value%roundValue != 0 {
+			fired[SignalNonRound] = append(fired[SignalNonRound], i)
+		}
+		// if out is change the rest is payment, a wallet would not spend
+		// an input it could do without
+		if on(SignalInput) && len(tx.Inputs) > 1 && errIn == nil && errOut == nil && errFee == nil {
+			payment := totalOut - out.Value
+			if totalIn-minIn < payment+fee {
+				fired[SignalInput] = append(fired[SignalInput], i)
+			}
+		}
+	}
+	return fired
+}
+
+// Detect returns the change output of tx, nil if none stands out. A signal
+// counts only if it fires for exactly one output, as it tells nothing
+// otherwise.
+func (d *ChangeDetector) Detect(tx *chain.Transaction) *ChangeResult {
+	if tx.IsCoinbase() || len(tx.Inputs) == 0 || len(tx.Outputs) < 2 {
+		return nil
+	}
+	scores := make(map[int]float64)
+	reasons := make(map[int][]string)
+	for signal, outputs := range d.signals(tx) {
+		if len(outputs) != 1 {
+			continue
+		}
+		i := outputs[0]
+		scores[i] += d.opts.Weights[signal]
+		reasons[i] = append(reasons[i], signal)
+	}
+	best, tie := -1, false
+	for i, score := range scores {
+		switch {
+		case best < 0 || score > scores[best]:
+			best, tie = i, false
+		case score == scores[best]:
+			tie = true
+		}
+	}
+	if best < 0 || tie || scores[best] < d.opts.Threshold {
+		return nil
+	}
+	sort.Strings(reasons[best])
+	out := tx.Outputs[best]
+	return &ChangeResult{Txid: tx.Txid, Index: best, Address: out.Address, Value: out.Value, Score: scores[best], Signals: reasons[best]}
+}
+
+// record keeps a change output used to link addresses
+func (d *ChangeDetector) record(r *ChangeResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.links[r.Txid] = *r
+}
+
+// Links lists change outputs which linked addresses, by txid.
+func (d *ChangeDetector) Links() []ChangeResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	links := make([]ChangeResult, 0, len(d.links))
+	for _, r := range d.links {
+		links = append(links, r)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Txid < links[j].Txid })
+	return links
+}
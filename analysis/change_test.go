@@ -0,0 +1,119 @@
+package analysis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+// p2wpkh addresses
+var (
+	segwitA = "bc1q" + strings.Repeat("a", 38)
+	segwitB = "bc1q" + strings.Repeat("b", 38)
+	segwitC = "bc1q" + strings.Repeat("c", 38)
+)
+
+type coin struct {
+	addr  string
+	value chain.Amount
+}
+
+// tx at position 0 of height spending ins to outs
+func changeTx(txid string, height uint, ins []coin, outs ...coin) chain.Transaction {
+	tx := chain.Transaction{Txid: txid}
+	tx.Block.Height = height
+	for _, c := range ins {
+		tx.Inputs = append(tx.Inputs, chain.TxInput{Txid: "prev", Address: c.addr, Value: c.value})
+	}
+	for _, c := range outs {
+		tx.Outputs = append(tx.Outputs, chain.TxOutput{Address: c.addr, Value: c.value})
+	}
+	return tx
+}
+
+// options with only the given signals on, at weight 1
+func only(threshold float64, signals ...string) ChangeOptions {
+	opts := ChangeOptions{Weights: make(map[string]float64), Threshold: threshold}
+	for _, s := range signals {
+		opts.Weights[s] = 1
+	}
+	return opts
+}
+
+func TestChangeDetector(t *testing.T) {
+	// 1Pay and segwitB got coins before, so they are not fresh later
+	earlier := changeTx("t0", 1, []coin{{"1Old", 100000}}, coin{"1Pay", 50000}, coin{segwitB, 40000})
+	tests := []struct {
+		name    string
+		tx      chain.Transaction
+		opts    ChangeOptions
+		index   int // -1 if no change
+		signals []string
+	}{
+		{"fresh", changeTx("t1", 2, []coin{{"1A", 100000}}, coin{"1Pay", 50000}, coin{"1Change", 40000}),
+			only(1, SignalFresh), 1, []string{SignalFresh}},
+		{"fresh paid back to the input", changeTx("t2", 2, []coin{{"1A", 100000}}, coin{"1Pay", 50000}, coin{"1A", 40000}),
+			only(1, SignalFresh), -1, nil},
+		{"address type", changeTx("t3", 2, []coin{{segwitA, 100000}}, coin{"1Pay", 50000}, coin{segwitB, 40000}),
+			only(1, SignalType), 1, []string{SignalType}},
+		{"non round", changeTx("t4", 2, []coin{{"1A", 100000}}, coin{"1Pay", 50000}, coin{"1B", 43210}),
+			only(1, SignalNonRound), 1, []string{SignalNonRound}},
+		{"unnecessary input", changeTx("t5", 2, []coin{{"1A", 1000}, {"1B", 1000}}, coin{"1Pay", 1500}, coin{"1C", 400}),
+			only(1, SignalInput), 1, []string{SignalInput}},
+		{"no input is unnecessary with one input", changeTx("t6", 2, []coin{{"1A", 2000}}, coin{"1Pay", 1500}, coin{"1C", 400}),
+			only(1, SignalInput), -1, nil},
+		{"fires for every output", changeTx("t7", 2, []coin{{"1A", 100000}}, coin{"1B", 51234}, coin{"1C", 43210}),
+			only(1, SignalNonRound), -1, nil},
+		{"tie", changeTx("t8", 2, []coin{{segwitA, 100000}}, coin{segwitB, 50000}, coin{"1C", 43210}),
+			only(1, SignalType, SignalNonRound), -1, nil},
+		{"below threshold", changeTx("t9", 2, []coin{{"1A", 100000}}, coin{"1Pay", 50000}, coin{"1B", 43210}),
+			only(1.5, SignalNonRound), -1, nil},
+		{"weights add up", changeTx("t10", 2, []coin{{segwitA, 100000}}, coin{"1Pay", 50000}, coin{segwitC, 43210}),
+			DefaultChangeOptions(), 1, []string{SignalType, SignalFresh, SignalNonRound}},
+		{"weight 0 is off", changeTx("t11", 2, []coin{{segwitA, 100000}}, coin{"1Pay", 50000}, coin{segwitC, 43210}),
+			ChangeOptions{Weights: map[string]float64{SignalFresh: 0, SignalType: 1, SignalNonRound: 0.5}, Threshold: 1.5},
+			1, []string{SignalType, SignalNonRound}},
+		{"one output", changeTx("t12", 2, []coin{{"1A", 100000}}, coin{"1Change", 43210}),
+			only(1, SignalFresh, SignalNonRound), -1, nil},
+	}
+	for _, test := range tests {
+		d := NewChangeDetector([]chain.Transaction{earlier, test.tx}, test.opts)
+		r := d.Detect(&test.tx)
+		if test.index < 0 {
+			if r != nil {
+				t.Errorf("%s: change %v, want none", test.name, r)
+			}
+			continue
+		}
+		if r == nil {
+			t.Errorf("%s: no change, want output %d", test.name, test.index)
+			continue
+		}
+		score := 0.0
+		for _, s := range test.signals {
+			score += test.opts.Weights[s]
+		}
+		// signals are reported sorted by name
+		if r.Index != test.index || r.Address != test.tx.Outputs[test.index].Address || r.Score != score || !reflect.DeepEqual(r.Signals, test.signals) {
+			t.Errorf("%s: change %v, want output %d by %v", test.name, r, test.index, test.signals)
+		}
+	}
+}
+
+func TestParseChangeSignals(t *testing.T) {
+	opts, err := ParseChangeSignals([]string{"fresh", "non_round=2", "address_type=0"}, 1.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{SignalFresh: 1, SignalNonRound: 2, SignalType: 0}
+	if !reflect.DeepEqual(opts.Weights, want) || opts.Threshold != 1.2 {
+		t.Fatalf("options %+v, want weights %v", opts, want)
+	}
+	for _, items := range [][]string{{"bogus"}, {"fresh", "freshness=1"}, {"fresh=-1"}, {"fresh=lots"}} {
+		if _, err := ParseChangeSignals(items, 1); err == nil {
+			t.Errorf("%v: no error", items)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package analysis
 
 import (
 	"bufio"
@@ -7,94 +7,22 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/kevin2li/go_learn/utils"
 	"github.com/pkg/errors"
-	pb "github.com/schollz/progressbar/v3"
 	cli "github.com/spf13/cobra"
 )
 
-type Transaction struct {
-	Txid     string `json:"txid"`
-	Size     uint   `json:"size"`
-	Version  uint   `json:"version"`
-	Locktime uint   `json:"locktime"`
-	Fee      uint   `json:"fee"`
-	Inputs   []struct {
-		Coinbase  bool     `json:"coinbase"`
-		Txid      string   `json:"txid"`
-		Output    uint     `json:"output"`
-		Sigscript string   `json:"sigscript"`
-		Sequence  uint64   `json:"sequence"`
-		Pkscript  string   `json:"pkscript"`
-		Value     uint     `json:"value"`
-		Address   string   `json:"address"`
-		Witness   []string `json:"witness"`
-	} `json:"inputs"`
-	Outputs []struct {
-		Address  string `json:"address"`
-		Pkscript string `json:"pkscript"`
-		Value    uint   `json:"value"`
-		Spent    bool   `json:"spent"`
-		Spender  struct {
-			Txid  string `json:"txid"`
-			Input uint   `json:"input"`
-		} `json:"spender,omitempty"`
-		Input uint `json:"input,omitempty"`
-	} `json:"outputs"`
-	Block struct {
-		Height   uint `json:"height"`
-		Position uint `json:"position"`
-	} `json:"block"`
-	Deleted bool `json:"deleted"`
-	Time    uint `json:"time"`
-	Rbf     bool `json:"rbf"`
-	Weight  uint `json:"weight"`
-}
-
-type HashSet map[string]bool
-
-func (h HashSet) Len() int {
-	return len(h)
-}
-
-func (h HashSet) Add(s string) {
-	if _, ok := h[s]; !ok {
-		h[s] = true
-	}
-}
-
-func (h HashSet) Remove(s string) error {
-	if _, ok := h[s]; !ok {
-		return errors.New(fmt.Sprintf("KeyError: Key `%s` does not exist!", s))
-	}
-	delete(h, s)
-	return nil
-}
-
-func (h HashSet) GetData() []string {
-	var result []string
-	for k := range h {
-		result = append(result, k)
-	}
-	return result
-}
-
-// remove duplicate addrs
-func Unique(addrs []string) []string {
-	set := make(HashSet)
-	for _, addr := range addrs {
-		set.Add(addr)
-	}
-	result := set.GetData()
-	return result
-}
-
-func ReadTransaction(path string) ([]Transaction, error) {
-	var txs []Transaction
-	obj, err := os.ReadFile(path)
+// ReadTransaction reads a block file saved by the crawler, json array or
+// json lines, plain or compressed with gzip or zstd.
+func ReadTransaction(path string) ([]chain.Transaction, error) {
+	var txs []chain.Transaction
+	obj, err := fs.ReadBlock(path)
 	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("read file: %s error", path))
 		return nil, err
 	}
 	err = json.Unmarshal(obj, &txs)
@@ -105,16 +33,22 @@ func ReadTransaction(path string) ([]Transaction, error) {
 	return txs, nil
 }
 
-func ReadTransactionDir(blockDir string) ([]Transaction, error) {
-	var all_txs []Transaction
+func ReadTransactionDir(blockDir string) ([]chain.Transaction, error) {
+	var all_txs []chain.Transaction
 	files, err := os.ReadDir(blockDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 	n := len(files)
-	bar := GetProgressBar(n)
+	bar := utils.GetProgressBar(n)
 	defer bar.Close()
 	for _, file := range files {
+		// skip crawler bookkeeping files such as checkpoint.jsonl and
+		// unfinished `.part` downloads
+		if file.IsDir() || !fs.IsBlockFile(file.Name()) {
+			bar.Add(1)
+			continue
+		}
 		block_height_path := filepath.Join(blockDir, file.Name())
 		bar.Describe(fmt.Sprintf("loading tx in %s:", file.Name()))
 		txs, err := ReadTransaction(block_height_path)
@@ -128,208 +62,271 @@ func ReadTransactionDir(blockDir string) ([]Transaction, error) {
 	return all_txs, nil
 }
 
-func GetTxInAddrs(tx Transaction) []string {
-	var in_addrs []string
-	for _, utxo := range tx.Inputs {
-		if utxo.Address != "" {
-			in_addrs = append(in_addrs, utxo.Address)
-		}
-	}
-	return in_addrs
-}
-
-func GetTxOutAddrs(tx Transaction) []string {
-	var out_addrs []string
-	for _, utxo := range tx.Outputs {
-		if utxo.Address != "" {
-			out_addrs = append(out_addrs, utxo.Address)
-		}
-	}
-	return out_addrs
-}
-
-func GetTxTime(tx Transaction) string {
+func GetTxTime(tx chain.Transaction) string {
 	timeLayout := "2006-01-02 15:04:05"
 	return time.Unix(int64(tx.Time), 0).Format(timeLayout)
 }
 
-// if given addr in tx inputs
-func IsInTxInputs(addr string, tx Transaction) bool {
-	in_addrs := GetTxInAddrs(tx)
-	for _, cur_addr := range in_addrs {
-		if cur_addr == addr {
-			return true
-		}
+// ReadDataset reads txs of a block file, or of all block files in a
+// directory.
+func ReadDataset(path string) ([]chain.Transaction, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read dataset %s error", path))
+		return nil, err
 	}
-	return false
-}
-
-// if given addr in tx outputs
-func IsInTxOutputs(addr string, tx Transaction) bool {
-	out_addrs := GetTxOutAddrs(tx)
-	for _, cur_addr := range out_addrs {
-		if cur_addr == addr {
-			return true
-		}
+	if info.IsDir() {
+		return ReadTransactionDir(path)
 	}
-	return false
+	return ReadTransaction(path)
 }
 
-func IsCoinbaseTx(tx Transaction) bool {
-	return tx.Inputs[0].Coinbase
+// ClusterReport is a line of `cluster all` output.
+type ClusterReport struct {
+	Id        int              `json:"id"`
+	Size      int              `json:"size"`
+	Addresses []string         `json:"addresses"`
+	Links     []ChangeResult   `json:"change_links,omitempty"` // change outputs merged into the cluster
+	CoinJoins []chain.CoinJoin `json:"coinjoins,omitempty"`    // CoinJoins spending from the cluster
 }
 
-func MultiInputHeuristic(addr string, tx Transaction) []string {
-	if IsInTxInputs(addr, tx) {
-		in_addrs := GetTxInAddrs(tx)
-		return in_addrs
+func loadClusters(dataset_path string, change ChangeOptions, guard *CoinJoinGuard) (*UnionFind, *ChangeDetector) {
+	log.Println("INFO: Loading transactions....")
+	all_txs, err := ReadDataset(dataset_path)
+	if err != nil {
+		log.Fatal(err)
 	}
-	return nil
+	log.Printf("INFO: Load %d transactions done!\n", len(all_txs))
+	detector := NewChangeDetector(all_txs, change)
+	clusters := ClusterAll(all_txs, detector, guard)
+	log.Printf("INFO: %d addresses clustered, %d coinjoins found\n", clusters.Len(), len(guard.Found()))
+	return clusters, detector
 }
 
-func CoinbaseHeuristic(addr string, tx Transaction) []string {
-	if IsCoinbaseTx(tx) && IsInTxOutputs(addr, tx) {
-		out_addrs := GetTxOutAddrs(tx)
-		return out_addrs
+// StartCluster prints the cluster of start_addr, clustering only txs the
+// index of the dataset links to it. The index is loaded from index_path if
+// saved there before.
+func StartCluster(dataset_path string, index_path string, start_addr string, change ChangeOptions, guard *CoinJoinGuard) {
+	log.Println("INFO: Loading transactions....")
+	all_txs, err := ReadDataset(dataset_path)
+	if err != nil {
+		log.Fatal(err)
 	}
-	return nil
-}
-
-// TODO: ChangeHeuristic
-func ChangeHeuristic(addr string, tx Transaction) []string {
-
-	return nil
-}
-
-func ClusterByAddr(addr string, txs []Transaction, addrList chan []string) {
-	var result []string
-	result = append(result, addr)
-	for _, tx := range txs {
-		// rule1
-		out := MultiInputHeuristic(addr, tx)
-		if out != nil {
-			result = append(result, out...)
+	log.Printf("INFO: Load %d transactions done!\n", len(all_txs))
+	index, err := OpenIndex(index_path, all_txs)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	detector := NewChangeDetector(all_txs, change)
+	log.Printf("INFO: Start cluster from address: %s!\n", start_addr)
+	clusters := ClusterFrom(start_addr, all_txs, index, detector, guard)
+	result := clusters.ClusterOf(start_addr)
+	if result == nil {
+		log.Fatalf("address %s not found in %s\n", start_addr, dataset_path)
+	}
+	fmt.Println("\n--------------------------------Cluster Finished!--------------------------------")
+	fmt.Printf("INFO: cluster total %d addresses, final cluster result:\n %v\n", len(result), result)
+	// why change heuristic linked addresses, for analysts to check
+	var links []ChangeResult
+	for _, link := range detector.Links() {
+		if clusters.Same(link.Address, start_addr) {
+			links = append(links, link)
+		}
+	}
+	if len(links) > 0 {
+		fmt.Printf("INFO: %d change outputs linked to inputs:\n", len(links))
+		for _, link := range links {
+			fmt.Printf("  %s\n", link)
 		}
-		// rule2
-		out = CoinbaseHeuristic(addr, tx)
-		if out != nil {
-			result = append(result, out...)
+	}
+	coinjoins := guard.touching(func(addr string) int {
+		if clusters.Same(addr, start_addr) {
+			return 0
 		}
-		// rule3
-		out = ChangeHeuristic(addr, tx)
-		if out != nil {
-			result = append(result, out...)
+		return -1
+	})[0]
+	if len(coinjoins) > 0 {
+		fmt.Printf("INFO: %d coinjoins spent from the cluster:\n", len(coinjoins))
+		for _, cj := range coinjoins {
+			fmt.Printf("  %s at %d: %s, %d inputs, %d of %d outputs of %s\n", cj.Txid, cj.Height, cj.Kind, cj.Inputs, cj.Equal, cj.Outputs, cj.Value)
 		}
 	}
-	result = Unique(result)
-	addrList <- result
 }
 
-func Cluster(addr string, txs []Transaction) []string {
-	var finalAddrList = make(HashSet)
-	finalAddrList.Add(addr)
-	var queue = make([]string, 0)
-	queue = append(queue, addr)
-	var iterations = 1
-iter:
-	fmt.Printf("================================Iteration %d started!================================\n", iterations)
-	fmt.Printf("INFO: total: %d addresses.\n", len(queue))
-	var n = len(queue)
-	addrList := make(chan []string, n)
-	for i := 0; i < n; i++ {
-		addr := queue[i]
-		fmt.Printf("[%d/%d] Starting cluster from address: %s\n", i+1, n, addr)
-		go ClusterByAddr(addr, txs, addrList)
-	}
-	queue = make([]string, 0) // clear queue
-	for i := 0; i < n; i++ {
-		addrs := <-addrList
-		for _, addr := range addrs {
-			if _, ok := finalAddrList[addr]; !ok {
-				queue = append(queue, addr)
-				finalAddrList.Add(addr)
+// StartClusterAll writes every cluster with at least min_size addresses as
+// json lines into output, or prints them if output is empty.
+func StartClusterAll(dataset_path string, change ChangeOptions, guard *CoinJoinGuard, output string, min_size int) {
+	clusters, detector := loadClusters(dataset_path, change, guard)
+	all := clusters.Clusters()
+	index := make(map[string]int, clusters.Len())
+	for i, members := range all {
+		for _, addr := range members {
+			index[addr] = i
+		}
+	}
+	links := make(map[int][]ChangeResult)
+	for _, link := range detector.Links() {
+		i := index[link.Address]
+		links[i] = append(links[i], link)
+	}
+	coinjoins := guard.touching(func(addr string) int {
+		if i, ok := index[addr]; ok {
+			return i
+		}
+		return -1
+	})
+	var out *bufio.Writer
+	if output != "" {
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, fmt.Sprintf("Open file `%s` error", output)))
+		}
+		defer f.Close()
+		out = bufio.NewWriter(f)
+		defer out.Flush()
+	}
+	written := 0
+	for i, members := range all {
+		if len(members) < min_size {
+			break
+		}
+		sort.Strings(members)
+		written++
+		if out == nil {
+			fmt.Printf("cluster %d: %d addresses: %v\n", i, len(members), members)
+			if len(coinjoins[i]) > 0 {
+				fmt.Printf("  spent in %d coinjoins\n", len(coinjoins[i]))
 			}
+			continue
 		}
+		line, _ := json.Marshal(ClusterReport{Id: i, Size: len(members), Addresses: members, Links: links[i], CoinJoins: coinjoins[i]})
+		out.Write(line)
+		out.WriteString("\n")
 	}
-	// whether have new address
-	if len(queue) > 0 {
-		fmt.Printf("INFO: new addresses added: %+v\n\n", queue)
-		iterations++
-		goto iter
+	largest := 0
+	if len(all) > 0 {
+		largest = len(all[0])
+	}
+	log.Printf("INFO: %d clusters of %d addresses, largest has %d addresses, %d change links, %d coinjoins\n",
+		len(all), clusters.Len(), largest, len(detector.Links()), len(guard.Found()))
+	if out != nil {
+		log.Printf("INFO: %d clusters with at least %d addresses saved at: %s\n", written, min_size, output)
 	}
-	result := finalAddrList.GetData()
-	return result
 }
 
-func GetProgressBar(max int) *pb.ProgressBar {
-	bar := pb.NewOptions(max,
-		// pb.OptionSetWriter(ansi.NewAnsiStdout()),
-		pb.OptionEnableColorCodes(true),
-		pb.OptionShowBytes(true),
-		pb.OptionSetWidth(15),
-		pb.OptionShowCount(),
-		pb.OptionThrottle(65*time.Millisecond),
-		pb.OptionOnCompletion(func() {
-			fmt.Fprint(os.Stderr, "\n")
-		}),
-		pb.OptionSetTheme(pb.Theme{
-			Saucer:        "[green]=[reset]",
-			SaucerHead:    "[green]>[reset]",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}))
-	return bar
+// StartAddrTxs prints every input and output each of addrs appears in,
+// the index is loaded from index_path if saved there before.
+func StartAddrTxs(dataset_path string, index_path string, addrs []string) {
+	log.Println("INFO: Loading transactions....")
+	all_txs, err := ReadDataset(dataset_path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("INFO: Load %d transactions done!\n", len(all_txs))
+	index, err := OpenIndex(index_path, all_txs)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	log.Printf("INFO: %d addresses indexed\n", len(index.Refs))
+	for _, addr := range addrs {
+		refs := index.Lookup(addr)
+		fmt.Printf("%s: %d inputs and outputs in %d txs\n", addr, len(refs), len(index.Txs(addr)))
+		for _, ref := range refs {
+			tx := all_txs[ref.Tx]
+			if ref.Output {
+				fmt.Printf("  %s %s out %d %s\n", GetTxTime(tx), tx.Txid, ref.Index, tx.Outputs[ref.Index].Value)
+			} else {
+				fmt.Printf("  %s %s in  %d %s\n", GetTxTime(tx), tx.Txid, ref.Index, tx.Inputs[ref.Index].Value)
+			}
+		}
+	}
 }
 
-func Save(path string, content []byte, flag int) error {
-	// check path exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		dir := filepath.Dir(path)
-		os.MkdirAll(dir, 0766)
-	}
-	// open or create file for writing
-	file, err := os.OpenFile(path, flag, 0666)
+// StartDBUpdate applies block files of dataset_path added since the last
+// update to the cluster db in db_path.
+func StartDBUpdate(dataset_path string, db_path string, change ChangeOptions, guard *CoinJoinGuard) {
+	db, err := OpenClusterDB(db_path)
 	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("Open file `%s` error", path))
-		return err
-	}
-	defer file.Close()
-	// write content
-	writer := bufio.NewWriter(file)
-	_, err = writer.Write(content)
-	writer.Flush()
+		log.Fatalf("%+v\n", err)
+	}
+	defer db.Close()
+	n, err := db.Update(dataset_path, change, guard)
 	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("save file `%s` error", path))
-		return err
+		log.Fatalf("%+v\n", err)
+	}
+	blocks, addrs, clusters := db.Stats()
+	if n == 0 {
+		log.Printf("INFO: no new block file in %s\n", dataset_path)
 	}
-	return nil
+	log.Printf("INFO: cluster db has %d block files, %d addresses in %d clusters\n", blocks, addrs, clusters)
 }
 
-func StartCluster(dataset_path string, start_addr string){
-	fmt.Println("INFO: Loading transactions....")
-	all_txs, err := ReadTransaction(dataset_path)
+// StartDBShow prints the cluster of addr in the cluster db and merges
+// which built it, or what the db holds if addr is empty.
+func StartDBShow(db_path string, addr string) {
+	db, err := OpenClusterDB(db_path)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("%+v\n", err)
+	}
+	defer db.Close()
+	if addr == "" {
+		blocks, addrs, clusters := db.Stats()
+		fmt.Printf("%d block files, %d addresses in %d clusters\n", blocks, addrs, clusters)
+		return
+	}
+	meta, members := db.Lookup(addr)
+	if meta == nil {
+		log.Fatalf("address %s not found in %s\n", addr, db_path)
+	}
+	fmt.Printf("cluster %d: %d addresses, blocks %d to %d, %d merges\n", meta.Id, meta.Size, meta.FirstHeight, meta.LastHeight, meta.Merges)
+	fmt.Printf("addresses: %v\n", members)
+	merges, err := db.Merges(meta.Id)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	for _, m := range merges {
+		rule := m.Rule
+		if m.CoinJoin != "" {
+			rule += " in " + m.CoinJoin + " coinjoin"
+		}
+		fmt.Printf("  block %d %s %s: %s + %s, cluster %d into %d, size %d\n", m.Height, m.Txid, rule, m.A, m.B, m.Merged, m.Cluster, m.Size)
 	}
-	fmt.Println("INFO: Load all transactions done!")
-	fmt.Printf("INFO: Start cluster from address: %s!\n", start_addr)
-	result := Cluster(start_addr, all_txs)
-	fmt.Println("\n--------------------------------Cluster Finished!--------------------------------")
-	fmt.Printf("INFO: cluster total %d addresses, final cluster result:\n %v\n", len(result), result)
 }
 
-func main() {
+// NewCommand is `cluster`, clustering addresses of saved transactions.
+func NewCommand() *cli.Command {
 	var (
 		dataset_path string // all_txs.json
 		start_addr   string // 1KFHE7w8BhaENAswwryaoccDb6qcT6DbYY
+		signals      []string
+		threshold    float64
+		output       string
+		min_size     int
+		index_path   string
+		db_path      string
+		coinjoin     string
 	)
-	var rootCmd = &cli.Command{Use: "analyzer"}
-
+	var options = func() (ChangeOptions, *CoinJoinGuard) {
+		if dataset_path == "" {
+			log.Fatalln("dataset path is required, give it by -f, --data-dir or analysis.dataset_path in config")
+		}
+		change, err := ParseChangeSignals(signals, threshold)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		guard, err := NewCoinJoinGuard(coinjoin)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		return change, guard
+	}
 	var clusterCmd = &cli.Command{
 		Use:   "cluster -f [dataset_path] [address]",
 		Short: "cluster address in given transcation dataset",
-		Long:  `cluster address in given transcation dataset.`,
+		Long: `cluster address in given transcation dataset, a block file or a directory
+	of block files. Only transactions linked to address are clustered, found
+	by an index of the dataset which is saved at --index and loaded from there
+	next time unless the dataset changed.`,
 		Args: func(cmd *cli.Command, args []string) error {
 			if len(args) != 1 {
 				return errors.New("you should only give one argument!")
@@ -337,18 +334,102 @@ func main() {
 			return nil
 		},
 		Run: func(cmd *cli.Command, args []string) {
+			change, guard := options()
 			t1 := time.Now()
 			log.Println("Started!")
 			start_addr = args[0]
-			StartCluster(dataset_path, start_addr)
+			StartCluster(dataset_path, index_path, start_addr, change, guard)
+			t2 := time.Now()
+			log.Println("Finished!")
+			fmt.Printf("Time elapsed: %.2f minutes\n", t2.Sub(t1).Minutes())
+		},
+	}
+	clusterCmd.PersistentFlags().StringVarP(&dataset_path, "dataset_path", "f", "", "path to load transcation dataset")
+	clusterCmd.PersistentFlags().StringSliceVar(&signals, "change-signals", []string{SignalFresh, SignalType, SignalNonRound + "=0.5", SignalInput},
+		"signals of change heuristic as name[=weight]: fresh, address_type, non_round, unnecessary_input, none if empty")
+	clusterCmd.PersistentFlags().Float64Var(&threshold, "change-threshold", DefaultChangeOptions().Threshold, "score an output needs to be taken as change")
+	clusterCmd.PersistentFlags().StringVar(&index_path, "index", "", "file to save the address index in, built in memory if empty")
+	clusterCmd.PersistentFlags().StringVar(&coinjoin, "coinjoin", CoinJoinSkip, "what to do with coinjoins: skip links of their inputs and change, flag them but link, off")
+
+	var allCmd = &cli.Command{
+		Use:   "all",
+		Short: "cluster every address in given transcation dataset",
+		Long: `cluster every address in given transcation dataset in one pass and list
+	the clusters with their sizes, larger ones first. Clusters are saved as
+	json lines with change outputs which linked them and coinjoins spending
+	from them if -o is given.`,
+		Args: cli.NoArgs,
+		Run: func(cmd *cli.Command, args []string) {
+			change, guard := options()
+			t1 := time.Now()
+			log.Println("Started!")
+			StartClusterAll(dataset_path, change, guard, output, min_size)
 			t2 := time.Now()
 			log.Println("Finished!")
 			fmt.Printf("Time elapsed: %.2f minutes\n", t2.Sub(t1).Minutes())
 		},
 	}
-	clusterCmd.Flags().StringVarP(&dataset_path, "dataset_path", "f", "", "path to load transcation dataset")
-	clusterCmd.MarkFlagRequired("dataset_path")
-	// Add subcommand
-	rootCmd.AddCommand(clusterCmd)
-	rootCmd.Execute()
+	allCmd.Flags().StringVarP(&output, "output", "o", "", "json lines file to save clusters, printed if empty")
+	allCmd.Flags().IntVar(&min_size, "min-size", 1, "list only clusters with at least this many addresses")
+	clusterCmd.AddCommand(allCmd)
+
+	var txsCmd = &cli.Command{
+		Use:   "txs [address...]",
+		Short: "list transactions of addresses in given transcation dataset",
+		Long: `list every input and output of addresses in given transcation dataset.
+	Addresses are looked up by an index of the dataset, which is saved at
+	--index and loaded from there next time unless the dataset changed.`,
+		Args: cli.MinimumNArgs(1),
+		Run: func(cmd *cli.Command, args []string) {
+			if dataset_path == "" {
+				log.Fatalln("dataset path is required, give it by -f, --data-dir or analysis.dataset_path in config")
+			}
+			StartAddrTxs(dataset_path, index_path, args)
+		},
+	}
+	clusterCmd.AddCommand(txsCmd)
+
+	var dbCmd = &cli.Command{
+		Use:   "db",
+		Short: "keep clusters in a database updated with new blocks",
+		Long: `keep clusters in a database directory, with every merge of clusters and
+	the transaction which caused it. Only block files added since the last
+	update are clustered. Once a block file applied to the database is
+	orphaned by a reorg, update fails and the database has to be removed and
+	built again.`,
+	}
+	dbCmd.PersistentFlags().StringVar(&db_path, "cluster-db", "", "directory of the cluster database")
+	var requireDB = func() {
+		if db_path == "" {
+			log.Fatalln("cluster db is required, give it by --cluster-db or analysis.cluster_db in config")
+		}
+	}
+	var updateCmd = &cli.Command{
+		Use:   "update",
+		Short: "cluster block files added to the dataset since the last update",
+		Args:  cli.NoArgs,
+		Run: func(cmd *cli.Command, args []string) {
+			requireDB()
+			change, guard := options()
+			t1 := time.Now()
+			StartDBUpdate(dataset_path, db_path, change, guard)
+			fmt.Printf("Time elapsed: %.2f minutes\n", time.Since(t1).Minutes())
+		},
+	}
+	var showCmd = &cli.Command{
+		Use:   "show [address]",
+		Short: "show the cluster of address and how it was merged",
+		Args:  cli.MaximumNArgs(1),
+		Run: func(cmd *cli.Command, args []string) {
+			requireDB()
+			addr := ""
+			if len(args) == 1 {
+				addr = args[0]
+			}
+			StartDBShow(db_path, addr)
+		},
+	}
+	dbCmd.AddCommand(updateCmd, showCmd)
+	clusterCmd.AddCommand(dbCmd)
+	return clusterCmd
 }
@@ -0,0 +1,114 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/pkg/errors"
+)
+
+// what clustering does with CoinJoins, set by `--coinjoin`
+const (
+	CoinJoinSkip = "skip" // inputs and change of CoinJoins are not linked
+	CoinJoinFlag = "flag" // linked anyway, but listed in the report
+	CoinJoinOff  = "off"  // not detected
+)
+
+// a CoinJoin found and its input addresses, to tell which clusters it
+// touches
+type coinJoinTx struct {
+	chain.CoinJoin
+	inputs []string
+}
+
+// CoinJoinGuard keeps the multi-input and change heuristics away from
+// CoinJoins, whose inputs have many owners, and keeps the CoinJoins found
+// for the cluster report. A nil guard detects nothing.
+type CoinJoinGuard struct {
+	mode string
+
+	mu    sync.Mutex
+	found map[string]coinJoinTx // by txid
+}
+
+func NewCoinJoinGuard(mode string) (*CoinJoinGuard, error) {
+	switch mode {
+	case CoinJoinSkip, CoinJoinFlag, CoinJoinOff:
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown coinjoin mode `%s`, should be one of skip, flag, off", mode))
+	}
+	return &CoinJoinGuard{mode: mode, found: make(map[string]coinJoinTx)}, nil
+}
+
+// Check returns the CoinJoin tx is and keeps it, nil if tx is none or
+// detection is off.
+func (g *CoinJoinGuard) Check(tx *chain.Transaction) *chain.CoinJoin {
+	if g == nil || g.mode == CoinJoinOff {
+		return nil
+	}
+	cj := tx.DetectCoinJoin()
+	if cj == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.found[tx.Txid] = coinJoinTx{*cj, tx.InputAddresses()}
+	return cj
+}
+
+// skips tells whether heuristics should leave cj alone
+func (g *CoinJoinGuard) skips(cj *chain.CoinJoin) bool {
+	return cj != nil && g.mode == CoinJoinSkip
+}
+
+// Found lists CoinJoins found, by height.
+func (g *CoinJoinGuard) Found() []chain.CoinJoin {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	found := make([]chain.CoinJoin, 0, len(g.found))
+	for _, cj := range g.found {
+		found = append(found, cj.CoinJoin)
+	}
+	sortCoinJoins(found)
+	return found
+}
+
+// touching lists CoinJoins found with an input in a cluster, by the
+// cluster id given by clusterOf, which is -1 for no cluster.
+func (g *CoinJoinGuard) touching(clusterOf func(addr string) int) map[int][]chain.CoinJoin {
+	byCluster := make(map[int][]chain.CoinJoin)
+	if g == nil {
+		return byCluster
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, cj := range g.found {
+		seen := make(map[int]bool)
+		for _, addr := range cj.inputs {
+			id := clusterOf(addr)
+			if id < 0 || seen[id] {
+				continue
+			}
+			seen[id] = true
+			byCluster[id] = append(byCluster[id], cj.CoinJoin)
+		}
+	}
+	for _, found := range byCluster {
+		sortCoinJoins(found)
+	}
+	return byCluster
+}
+
+func sortCoinJoins(found []chain.CoinJoin) {
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Height != found[j].Height {
+			return found[i].Height < found[j].Height
+		}
+		return found[i].Txid < found[j].Txid
+	})
+}
@@ -0,0 +1,55 @@
+package analysis
+
+import (
+	"testing"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+// a JoinMarket-like tx of 3 owners, paying 3 equal outputs and a change
+func joinMarketTx() chain.Transaction {
+	tx := testTx("cj", []string{"a", "b", "c"}, "m1", "m2", "m3", "ch")
+	for i := 0; i < 3; i++ {
+		tx.Outputs[i].Value = 250
+	}
+	tx.Outputs[3].Value = 150
+	return tx
+}
+
+func TestCoinJoinGuard(t *testing.T) {
+	if _, err := NewCoinJoinGuard("ignore"); err == nil {
+		t.Fatal("NewCoinJoinGuard(ignore) succeeded")
+	}
+	txs := []chain.Transaction{joinMarketTx(), testTx("pay", []string{"a", "d"}, "e")}
+	for _, c := range []struct {
+		mode   string
+		linked bool // inputs of the coinjoin linked
+		found  int
+	}{
+		{CoinJoinSkip, false, 1},
+		{CoinJoinFlag, true, 1},
+		{CoinJoinOff, true, 0},
+	} {
+		guard, err := NewCoinJoinGuard(c.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := ClusterAll(txs, NewChangeDetector(txs, DefaultChangeOptions()), guard)
+		if u.Same("a", "b") != c.linked || !u.Same("a", "d") {
+			t.Errorf("%s: inputs of the coinjoin linked %v, want %v", c.mode, u.Same("a", "b"), c.linked)
+		}
+		found := guard.Found()
+		if len(found) != c.found {
+			t.Fatalf("%s: %d coinjoins found, want %d", c.mode, len(found), c.found)
+		}
+		if c.found > 0 && (found[0].Txid != "cj" || found[0].Kind != chain.CoinJoinJoinMarket) {
+			t.Errorf("%s: found %+v", c.mode, found[0])
+		}
+	}
+
+	// nil guard detects nothing and links everything
+	u := ClusterAll(txs, nil, nil)
+	if !u.Same("a", "b") {
+		t.Fatal("nil guard skipped the coinjoin")
+	}
+}
@@ -0,0 +1,468 @@
+package analysis
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/kevin2li/go_learn/utils"
+	"github.com/pkg/errors"
+)
+
+// files of the cluster db directory
+const (
+	snapshotFile = "clusters.gob"
+	mergesFile   = "merges.jsonl"
+)
+
+// written by `crawler sync` into the block directory
+const reorgEventsFile = "reorg_events.jsonl"
+
+// ClusterMeta describes a cluster of the db, its id is the id of one of
+// its addresses and kept when other clusters are merged into it.
+type ClusterMeta struct {
+	Id          int  `json:"id"`
+	Size        int  `json:"size"`
+	FirstHeight uint `json:"first_height"` // block the cluster first appears in
+	LastHeight  uint `json:"last_height"`  // latest block with a tx of the cluster
+	Merges      int  `json:"merges"`       // clusters merged into this one
+}
+
+// Merge is a line of the merge journal: tx linked addresses A and B by
+// rule, so cluster Merged went into Cluster.
+type Merge struct {
+	Height   uint          `json:"height"`
+	Txid     string        `json:"txid"`
+	Rule     string        `json:"rule"`
+	A        string        `json:"a"`
+	B        string        `json:"b"`
+	Cluster  int           `json:"cluster"`
+	Merged   int           `json:"merged"`
+	Size     int           `json:"size"` // size of Cluster after the merge
+	Change   *ChangeResult `json:"change,omitempty"`
+	CoinJoin string        `json:"coinjoin,omitempty"` // kind of CoinJoin tx is, if flagged
+	Time     int64         `json:"time"`
+}
+
+// dbState is the snapshot of the db, members of clusters are not saved
+// but rebuilt from Parent.
+type dbState struct {
+	Addrs    []string
+	Parent   []int
+	Clusters map[int]*ClusterMeta // by id
+	Blocks   map[string]int       // applied block files and their tx count
+	MergeLog int64                // size of the merge journal at the snapshot
+	Reorgs   int                  // reorg events of the block directory checked
+}
+
+// ClusterDB keeps clusters of a dataset in a directory and updates them
+// with block files added since the last update, rather than clustering
+// the whole dataset again. Every merge is appended to a journal with the
+// tx which caused it, the state is saved as a snapshot after the journal,
+// so merges of an update which did not finish are dropped when opened.
+//
+// Clusters are never split. Update reads the reorg events of the block
+// directory and refuses to go on once a block file it applied was
+// orphaned, the db has to be built again then.
+type ClusterDB struct {
+	dir      string
+	u        *UnionFind
+	clusters map[int]*ClusterMeta
+	blocks   map[string]int
+	journal  *os.File
+	writer   *bufio.Writer
+	mergeLog int64
+	reorgs   int
+}
+
+func OpenClusterDB(dir string) (*ClusterDB, error) {
+	if err := os.MkdirAll(dir, 0766); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("create cluster db `%s` failed", dir))
+		return nil, err
+	}
+	db := &ClusterDB{
+		dir:      dir,
+		u:        NewUnionFind(),
+		clusters: make(map[int]*ClusterMeta),
+		blocks:   make(map[string]int),
+	}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, mergesFile)
+	journal, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("open merge journal `%s` failed", path))
+		return nil, err
+	}
+	// drop merges written after the snapshot
+	if err := journal.Truncate(db.mergeLog); err != nil {
+		journal.Close()
+		err = errors.Wrap(err, fmt.Sprintf("truncate merge journal `%s` failed", path))
+		return nil, err
+	}
+	if _, err := journal.Seek(db.mergeLog, 0); err != nil {
+		journal.Close()
+		err = errors.Wrap(err, fmt.Sprintf("seek merge journal `%s` failed", path))
+		return nil, err
+	}
+	db.journal = journal
+	db.writer = bufio.NewWriter(journal)
+	return db, nil
+}
+
+func (db *ClusterDB) load() error {
+	path := filepath.Join(db.dir, snapshotFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read cluster db `%s` failed", path))
+		return err
+	}
+	defer f.Close()
+	var state dbState
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&state); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("decode cluster db `%s` failed", path))
+		return err
+	}
+	u := db.u
+	u.addrs, u.parent = state.Addrs, state.Parent
+	u.size = make([]int, len(u.addrs))
+	u.members = make([][]int, len(u.addrs))
+	for id, addr := range u.addrs {
+		u.ids[addr] = id
+	}
+	for id := range u.addrs {
+		root := u.find(id)
+		u.members[root] = append(u.members[root], id)
+		u.size[root]++
+	}
+	// gob leaves empty maps nil
+	if state.Clusters != nil {
+		db.clusters = state.Clusters
+	}
+	if state.Blocks != nil {
+		db.blocks = state.Blocks
+	}
+	db.mergeLog = state.MergeLog
+	db.reorgs = state.Reorgs
+	return nil
+}
+
+// save writes the journal, then the snapshot
+func (db *ClusterDB) save() error {
+	if err := db.writer.Flush(); err != nil {
+		err = errors.Wrap(err, "write merge journal failed")
+		return err
+	}
+	if err := db.journal.Sync(); err != nil {
+		err = errors.Wrap(err, "sync merge journal failed")
+		return err
+	}
+	path := filepath.Join(db.dir, snapshotFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Open file `%s` error", tmp))
+		return err
+	}
+	state := dbState{Addrs: db.u.addrs, Parent: db.u.parent, Clusters: db.clusters, Blocks: db.blocks, MergeLog: db.mergeLog, Reorgs: db.reorgs}
+	w := bufio.NewWriter(f)
+	if err := gob.NewEncoder(w).Encode(&state); err != nil {
+		f.Close()
+		err = errors.Wrap(err, fmt.Sprintf("save cluster db `%s` error", path))
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		err = errors.Wrap(err, fmt.Sprintf("save cluster db `%s` error", path))
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		err = errors.Wrap(err, fmt.Sprintf("save cluster db `%s` error", path))
+		return err
+	}
+	if err := f.Close(); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("save cluster db `%s` error", path))
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (db *ClusterDB) Close() error {
+	return db.journal.Close()
+}
+
+// add puts addr into the db, a new address is a cluster of its own
+func (db *ClusterDB) add(addr string, height uint) {
+	known := db.u.Len()
+	id := db.u.Add(addr)
+	if id == known {
+		db.clusters[id] = &ClusterMeta{Id: id, Size: 1, FirstHeight: height, LastHeight: height}
+		return
+	}
+	if meta := db.clusters[db.u.find(id)]; height > meta.LastHeight {
+		meta.LastHeight = height
+	}
+}
+
+// union merges clusters of a and b, the smaller one goes into the larger
+// one, and journals the merge. It returns whether they were merged.
+func (db *ClusterDB) union(a, b string, rule string, change *ChangeResult, tx *chain.Transaction, cj *chain.CoinJoin) (bool, error) {
+	ra, rb := db.u.find(db.u.ids[a]), db.u.find(db.u.ids[b])
+	if !db.u.Union(a, b) {
+		return false, nil
+	}
+	kept, merged := ra, rb
+	if db.u.find(ra) != ra {
+		kept, merged = rb, ra
+	}
+	meta, old := db.clusters[kept], db.clusters[merged]
+	meta.Size += old.Size
+	meta.Merges += old.Merges + 1
+	if old.FirstHeight < meta.FirstHeight {
+		meta.FirstHeight = old.FirstHeight
+	}
+	if old.LastHeight > meta.LastHeight {
+		meta.LastHeight = old.LastHeight
+	}
+	delete(db.clusters, merged)
+
+	m := Merge{Height: tx.Block.Height, Txid: tx.Txid, Rule: rule, A: a, B: b, Cluster: kept, Merged: merged,
+		Size: meta.Size, Change: change, Time: time.Now().Unix()}
+	if cj != nil {
+		m.CoinJoin = cj.Kind
+	}
+	line, _ := json.Marshal(m)
+	line = append(line, '\n')
+	if _, err := db.writer.Write(line); err != nil {
+		err = errors.Wrap(err, "write merge journal failed")
+		return true, err
+	}
+	db.mergeLog += int64(len(line))
+	return true, nil
+}
+
+// applyBlock clusters txs of one block file, addresses of earlier blocks
+// are not fresh for the change heuristic. It returns the number of merges.
+func (db *ClusterDB) applyBlock(txs []chain.Transaction, change ChangeOptions, guard *CoinJoinGuard) (int, error) {
+	detector := NewChangeDetector(txs, change)
+	for i := range txs {
+		for _, addr := range append(txs[i].InputAddresses(), txs[i].OutputAddresses()...) {
+			if _, ok := db.u.ids[addr]; ok {
+				detector.seenBefore(addr)
+			}
+		}
+	}
+	merges := 0
+	var err error
+	for i := range txs {
+		tx := &txs[i]
+		cj := guard.Check(tx)
+		linkTx(tx, detector, guard.skips(cj), func(addr string) { db.add(addr, tx.Block.Height) }, func(a, b, rule string, change *ChangeResult) bool {
+			if err != nil {
+				return false
+			}
+			var merged bool
+			if merged, err = db.union(a, b, rule, change, tx, cj); merged {
+				merges++
+			}
+			return merged && err == nil
+		})
+		if err != nil {
+			return merges, err
+		}
+	}
+	return merges, nil
+}
+
+// reorgEvent is the part of a reorg event of `crawler sync` the db needs
+type reorgEvent struct {
+	ForkHeight uint `json:"fork_height"`
+	Orphaned   []struct {
+		Height uint     `json:"height"`
+		Files  []string `json:"files"` // moved to `reorged/<hash>/`, named as before
+	} `json:"orphaned"`
+}
+
+func readReorgEvents(path string) ([]reorgEvent, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read file: %s error", path))
+		return nil, err
+	}
+	defer f.Close()
+	var events []reorgEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event reorgEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("invalid line in reorg events `%s`", path))
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		err = errors.Wrap(err, "scanner error")
+		return nil, err
+	}
+	return events, nil
+}
+
+// checkReorgs fails if a reorg event written since the last update
+// orphaned a block file the db applied, its txs can not be taken out of
+// the clusters.
+func (db *ClusterDB) checkReorgs(blockDir string) error {
+	events, err := readReorgEvents(filepath.Join(blockDir, reorgEventsFile))
+	if err != nil {
+		return err
+	}
+	// events file started again, check all of it
+	if db.reorgs > len(events) {
+		db.reorgs = 0
+	}
+	for _, event := range events[db.reorgs:] {
+		for _, block := range event.Orphaned {
+			for _, path := range block.Files {
+				if _, ok := db.blocks[filepath.Base(path)]; ok {
+					return errors.New(fmt.Sprintf("block %d applied to cluster db `%s` was orphaned by a reorg above height %d, "+
+						"remove the db and run update again to build it from the mainchain", block.Height, db.dir, event.ForkHeight))
+				}
+			}
+		}
+	}
+	db.reorgs = len(events)
+	return nil
+}
+
+// Update clusters block files in blockDir not applied yet, lower heights
+// first, and saves the db. It returns how many files were applied.
+// CoinJoins found are kept by guard. It fails without applying anything
+// if a block file applied before was orphaned by a reorg.
+func (db *ClusterDB) Update(blockDir string, change ChangeOptions, guard *CoinJoinGuard) (int, error) {
+	if err := db.checkReorgs(blockDir); err != nil {
+		return 0, err
+	}
+	files, err := os.ReadDir(blockDir)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read dataset %s error", blockDir))
+		return 0, err
+	}
+	type blockFile struct {
+		name   string
+		height uint
+	}
+	var pending []blockFile
+	for _, file := range files {
+		height, ok := fs.BlockHeight(file.Name())
+		if file.IsDir() || !ok {
+			continue
+		}
+		if _, done := db.blocks[file.Name()]; !done {
+			pending = append(pending, blockFile{file.Name(), height})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].height < pending[j].height })
+	if len(pending) == 0 {
+		return 0, nil
+	}
+	bar := utils.GetProgressBar(len(pending))
+	defer bar.Close()
+	merges := 0
+	for _, file := range pending {
+		path := filepath.Join(blockDir, file.name)
+		bar.Describe(fmt.Sprintf("clustering tx in %s:", file.name))
+		txs, err := ReadTransaction(path)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("read %s error", path))
+			return 0, err
+		}
+		n, err := db.applyBlock(txs, change, guard)
+		if err != nil {
+			return 0, err
+		}
+		merges += n
+		db.blocks[file.name] = len(txs)
+		bar.Add(1)
+	}
+	if err := db.save(); err != nil {
+		return 0, err
+	}
+	log.Printf("INFO: %d block files applied, %d clusters merged, %d coinjoins found\n", len(pending), merges, len(guard.Found()))
+	return len(pending), nil
+}
+
+// Lookup returns the cluster of addr and its addresses, nil if addr is
+// not in the db.
+func (db *ClusterDB) Lookup(addr string) (*ClusterMeta, []string) {
+	members := db.u.ClusterOf(addr)
+	if members == nil {
+		return nil, nil
+	}
+	sort.Strings(members)
+	return db.clusters[db.u.find(db.u.ids[addr])], members
+}
+
+// Merges reads the journal for merges which built cluster id, oldest
+// first.
+func (db *ClusterDB) Merges(id int) ([]Merge, error) {
+	if err := db.writer.Flush(); err != nil {
+		err = errors.Wrap(err, "write merge journal failed")
+		return nil, err
+	}
+	path := filepath.Join(db.dir, mergesFile)
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read merge journal `%s` failed", path))
+		return nil, err
+	}
+	defer f.Close()
+	var all []Merge
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var m Merge
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("invalid line in merge journal `%s`", path))
+			return nil, err
+		}
+		all = append(all, m)
+	}
+	if err := scanner.Err(); err != nil {
+		err = errors.Wrap(err, "scanner error")
+		return nil, err
+	}
+	// walk back from the latest merge, collecting clusters merged into id
+	ids := map[int]bool{id: true}
+	var merges []Merge
+	for i := len(all) - 1; i >= 0; i-- {
+		if ids[all[i].Cluster] {
+			ids[all[i].Merged] = true
+			merges = append(merges, all[i])
+		}
+	}
+	for i, j := 0, len(merges)-1; i < j; i, j = i+1, j-1 {
+		merges[i], merges[j] = merges[j], merges[i]
+	}
+	return merges, nil
+}
+
+// Stats returns how many block files, addresses and clusters the db has.
+func (db *ClusterDB) Stats() (int, int, int) {
+	return len(db.blocks), db.u.Len(), len(db.clusters)
+}
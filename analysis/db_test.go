@@ -0,0 +1,137 @@
+package analysis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+// writeBlock saves txs as the block file of height in dir
+func writeBlock(t *testing.T, dir string, height uint, txs ...chain.Transaction) {
+	for i := range txs {
+		txs[i].Block.Height = height
+		txs[i].Block.Position = uint(i)
+	}
+	content, _ := json.Marshal(txs)
+	if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("block_height=%d.json", height)), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openTestDB(t *testing.T, dir string) *ClusterDB {
+	db, err := OpenClusterDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestClusterDBUpdate(t *testing.T) {
+	blocks, dir := t.TempDir(), t.TempDir()
+	none := ChangeOptions{}
+	writeBlock(t, blocks, 1, testTx("t1", []string{"a", "b"}, "p"))
+	db := openTestDB(t, dir)
+	if n, err := db.Update(blocks, none, nil); err != nil || n != 1 {
+		t.Fatalf("Update = %d, %v", n, err)
+	}
+	db.Close()
+
+	// merges after opening the db again
+	writeBlock(t, blocks, 2, testTx("t2", []string{"b", "c"}, "q"), testTx("t3", []string{"x", "y"}, "r"))
+	db = openTestDB(t, dir)
+	if n, err := db.Update(blocks, none, nil); err != nil || n != 1 {
+		t.Fatalf("Update = %d, %v", n, err)
+	}
+	meta, members := db.Lookup("c")
+	if meta == nil || !reflect.DeepEqual(members, []string{"a", "b", "c"}) || meta.Size != 3 || meta.FirstHeight != 1 || meta.LastHeight != 2 {
+		t.Fatalf("cluster of c = %+v, %v", meta, members)
+	}
+	merges, err := db.Merges(meta.Id)
+	if err != nil || len(merges) != 2 || merges[0].Txid != "t1" || merges[1].Txid != "t2" {
+		t.Fatalf("merges = %+v, %v", merges, err)
+	}
+	if blocks, addrs, clusters := db.Stats(); blocks != 2 || addrs != 8 || clusters != 5 {
+		t.Fatalf("stats = %d blocks, %d addresses, %d clusters", blocks, addrs, clusters)
+	}
+	if n, err := db.Update(blocks, none, nil); err != nil || n != 0 {
+		t.Fatalf("Update with nothing new = %d, %v", n, err)
+	}
+}
+
+func TestClusterDBJournalWriteFails(t *testing.T) {
+	blocks, dir := t.TempDir(), t.TempDir()
+	writeBlock(t, blocks, 1, testTx("t1", []string{"a", "b"}, "p"))
+	db := openTestDB(t, dir)
+	// a buffer smaller than a merge line writes through to the closed file
+	db.journal.Close()
+	db.writer = bufio.NewWriterSize(db.journal, 16)
+	if n, err := db.Update(blocks, ChangeOptions{}, nil); err == nil || n != 0 {
+		t.Fatalf("Update = %d, %v; want the journal error", n, err)
+	}
+	if blocks, _, _ := db.Stats(); blocks != 0 {
+		t.Fatalf("%d block(s) marked applied after the journal failed", blocks)
+	}
+}
+
+func TestClusterDBRefusesOrphanedBlocks(t *testing.T) {
+	blocks, dir := t.TempDir(), t.TempDir()
+	none := ChangeOptions{}
+	writeBlock(t, blocks, 1, testTx("t1", []string{"a", "b"}, "p"))
+	writeBlock(t, blocks, 2, testTx("t2", []string{"b", "c"}, "q"))
+	db := openTestDB(t, dir)
+	if _, err := db.Update(blocks, none, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reorg of a block not applied yet is fine
+	reorg := func(height uint) {
+		orphan := filepath.Join(blocks, "reorged", fmt.Sprintf("h%d", height))
+		os.MkdirAll(orphan, 0766)
+		name := fmt.Sprintf("block_height=%d.json", height)
+		os.Rename(filepath.Join(blocks, name), filepath.Join(orphan, name))
+		line := fmt.Sprintf(`{"time":1,"fork_height":%d,"orphaned":[{"height":%d,"hash":"h%d","files":[%q]}]}`+"\n",
+			height-1, height, height, filepath.Join(orphan, name))
+		f, _ := os.OpenFile(filepath.Join(blocks, reorgEventsFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		f.WriteString(line)
+		f.Close()
+	}
+	writeBlock(t, blocks, 3, testTx("t3", []string{"c", "d"}, "r"))
+	reorg(3)
+	writeBlock(t, blocks, 3, testTx("t3b", []string{"x", "y"}, "r"))
+	if n, err := db.Update(blocks, none, nil); err != nil || n != 1 {
+		t.Fatalf("Update = %d, %v", n, err)
+	}
+	if meta, _ := db.Lookup("x"); meta == nil || meta.Size != 2 {
+		t.Fatalf("cluster of x = %+v, want the replacement block applied", meta)
+	}
+	if _, err := db.Update(blocks, none, nil); err != nil {
+		t.Fatalf("Update with old events: %v", err)
+	}
+
+	// but not of a block applied
+	reorg(2)
+	writeBlock(t, blocks, 2, testTx("t2b", []string{"e", "f"}, "q"))
+	if _, err := db.Update(blocks, none, nil); err == nil {
+		t.Fatal("Update kept clusters of an orphaned block")
+	}
+	if meta, _ := db.Lookup("e"); meta != nil {
+		t.Fatal("Update applied blocks after finding an orphaned block")
+	}
+	db.Close()
+
+	// built again from the mainchain
+	db = openTestDB(t, t.TempDir())
+	if n, err := db.Update(blocks, none, nil); err != nil || n != 3 {
+		t.Fatalf("Update of a new db = %d, %v", n, err)
+	}
+	if db.u.Same("b", "c") || !db.u.Same("e", "f") {
+		t.Fatal("new db has clusters of the orphaned block")
+	}
+}
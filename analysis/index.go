@@ -0,0 +1,143 @@
+package analysis
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/pkg/errors"
+)
+
+// AddrRef is where an address appears: an input or output of a tx.
+type AddrRef struct {
+	Tx     int  // position of the tx in the dataset
+	Index  int  // input or output index
+	Output bool // an output if true, else an input
+}
+
+// AddrIndex maps every address to the inputs and outputs it appears in,
+// so looking up an address costs its degree rather than a scan of all txs.
+type AddrIndex struct {
+	Txids []string // txid of each tx position
+	Refs  map[string][]AddrRef
+}
+
+func BuildIndex(txs []chain.Transaction) *AddrIndex {
+	x := &AddrIndex{Txids: make([]string, len(txs)), Refs: make(map[string][]AddrRef)}
+	for i := range txs {
+		tx := &txs[i]
+		x.Txids[i] = tx.Txid
+		for j, in := range tx.Inputs {
+			if in.Address != "" {
+				x.Refs[in.Address] = append(x.Refs[in.Address], AddrRef{Tx: i, Index: j})
+			}
+		}
+		for j, out := range tx.Outputs {
+			if out.Address != "" {
+				x.Refs[out.Address] = append(x.Refs[out.Address], AddrRef{Tx: i, Index: j, Output: true})
+			}
+		}
+	}
+	return x
+}
+
+// Matches tells whether x was built from txs, a stale index must be built
+// again.
+func (x *AddrIndex) Matches(txs []chain.Transaction) bool {
+	if len(x.Txids) != len(txs) {
+		return false
+	}
+	for i := range txs {
+		if x.Txids[i] != txs[i].Txid {
+			return false
+		}
+	}
+	return true
+}
+
+func (x *AddrIndex) Degree(addr string) int {
+	return len(x.Refs[addr])
+}
+
+func (x *AddrIndex) Lookup(addr string) []AddrRef {
+	return x.Refs[addr]
+}
+
+// Txs lists positions of txs addr appears in, each once and in order.
+func (x *AddrIndex) Txs(addr string) []int {
+	var txs []int
+	for _, ref := range x.Refs[addr] {
+		// refs of one tx are next to each other
+		if len(txs) == 0 || txs[len(txs)-1] != ref.Tx {
+			txs = append(txs, ref.Tx)
+		}
+	}
+	return txs
+}
+
+// Save writes x with gob.
+func (x *AddrIndex) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0766); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("create directory of `%s` failed", path))
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Open file `%s` error", tmp))
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := gob.NewEncoder(w).Encode(x); err != nil {
+		f.Close()
+		err = errors.Wrap(err, fmt.Sprintf("save index `%s` error", path))
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		err = errors.Wrap(err, fmt.Sprintf("save index `%s` error", path))
+		return err
+	}
+	if err := f.Close(); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("save index `%s` error", path))
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func LoadIndex(path string) (*AddrIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read index %s error", path))
+		return nil, err
+	}
+	defer f.Close()
+	var x AddrIndex
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&x); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("decode index %s error", path))
+		return nil, err
+	}
+	return &x, nil
+}
+
+// OpenIndex loads the index saved at path if it was built from txs,
+// otherwise builds it and saves it there. No path builds it in memory.
+func OpenIndex(path string, txs []chain.Transaction) (*AddrIndex, error) {
+	if path == "" {
+		return BuildIndex(txs), nil
+	}
+	if x, err := LoadIndex(path); err == nil && x.Matches(txs) {
+		log.Printf("INFO: address index loaded from: %s\n", path)
+		return x, nil
+	}
+	x := BuildIndex(txs)
+	if err := x.Save(path); err != nil {
+		return nil, err
+	}
+	log.Printf("INFO: address index saved at: %s\n", path)
+	return x, nil
+}
@@ -0,0 +1,231 @@
+package analysis
+
+import (
+	"sort"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+// UnionFind is a disjoint-set of addresses, addresses in one set are owned
+// by one entity. Members of each set are kept by its root, so listing a
+// set costs its size.
+type UnionFind struct {
+	ids     map[string]int
+	addrs   []string
+	parent  []int
+	size    []int
+	members [][]int // ids in the set of each root, nil for other ids
+}
+
+func NewUnionFind() *UnionFind {
+	return &UnionFind{ids: make(map[string]int)}
+}
+
+// Add puts addr into a set of its own if it is new.
+func (u *UnionFind) Add(addr string) int {
+	if id, ok := u.ids[addr]; ok {
+		return id
+	}
+	id := len(u.addrs)
+	u.ids[addr] = id
+	u.addrs = append(u.addrs, addr)
+	u.parent = append(u.parent, id)
+	u.size = append(u.size, 1)
+	u.members = append(u.members, []int{id})
+	return id
+}
+
+func (u *UnionFind) find(id int) int {
+	for u.parent[id] != id {
+		// path halving
+		u.parent[id] = u.parent[u.parent[id]]
+		id = u.parent[id]
+	}
+	return id
+}
+
+// Union merges sets of a and b, adding them if new. It returns false if
+// they are in one set already.
+func (u *UnionFind) Union(a, b string) bool {
+	ra, rb := u.find(u.Add(a)), u.find(u.Add(b))
+	if ra == rb {
+		return false
+	}
+	// smaller set goes under the larger one
+	if u.size[ra] < u.size[rb] {
+		ra, rb = rb, ra
+	}
+	u.parent[rb] = ra
+	u.size[ra] += u.size[rb]
+	u.members[ra] = append(u.members[ra], u.members[rb]...)
+	u.members[rb] = nil
+	return true
+}
+
+// UnionAll merges sets of all addrs.
+func (u *UnionFind) UnionAll(addrs []string) {
+	for i := 1; i < len(addrs); i++ {
+		u.Union(addrs[0], addrs[i])
+	}
+	if len(addrs) == 1 {
+		u.Add(addrs[0])
+	}
+}
+
+func (u *UnionFind) Len() int {
+	return len(u.addrs)
+}
+
+// Same tells whether a and b are in one set.
+func (u *UnionFind) Same(a, b string) bool {
+	ia, ok := u.ids[a]
+	if !ok {
+		return false
+	}
+	ib, ok := u.ids[b]
+	if !ok {
+		return false
+	}
+	return u.find(ia) == u.find(ib)
+}
+
+// Size is the size of the set of addr, 0 if addr is unknown.
+func (u *UnionFind) Size(addr string) int {
+	id, ok := u.ids[addr]
+	if !ok {
+		return 0
+	}
+	return u.size[u.find(id)]
+}
+
+// ClusterOf lists addresses in the set of addr, nil if addr is unknown.
+func (u *UnionFind) ClusterOf(addr string) []string {
+	id, ok := u.ids[addr]
+	if !ok {
+		return nil
+	}
+	return u.names(u.members[u.find(id)])
+}
+
+func (u *UnionFind) names(ids []int) []string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = u.addrs[id]
+	}
+	return names
+}
+
+// Clusters lists all sets, larger ones first.
+func (u *UnionFind) Clusters() [][]string {
+	var clusters [][]string
+	for id, members := range u.members {
+		if u.parent[id] == id {
+			clusters = append(clusters, u.names(members))
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i]) != len(clusters[j]) {
+			return len(clusters[i]) > len(clusters[j])
+		}
+		return clusters[i][0] < clusters[j][0]
+	})
+	return clusters
+}
+
+// rules linking addresses, recorded with merges of the cluster db
+const (
+	RuleMultiInput = "multi_input"
+	RuleCoinbase   = "coinbase"
+	RuleChange     = "change"
+)
+
+// ClusterTx applies the heuristics to tx: inputs are merged, outputs of
+// coinbase are merged and change is merged with the inputs. Every address
+// of tx is added. Inputs and change of a CoinJoin are left alone if guard
+// skips them.
+func ClusterTx(u *UnionFind, tx *chain.Transaction, detector *ChangeDetector, guard *CoinJoinGuard) {
+	skip := guard.skips(guard.Check(tx))
+	linkTx(tx, detector, skip, func(addr string) { u.Add(addr) }, func(a, b, rule string, change *ChangeResult) bool {
+		return u.Union(a, b)
+	})
+}
+
+// linkTx calls add with every address of tx and union with every pair of
+// addresses the heuristics link, change is given for the change rule.
+// Inputs and change are not linked if skip, as for a CoinJoin. It is the
+// only place of the heuristics, for ClusterAll and the cluster db alike.
+func linkTx(tx *chain.Transaction, detector *ChangeDetector, skip bool, add func(addr string), union func(a, b, rule string, change *ChangeResult) bool) {
+	in_addrs, out_addrs := tx.InputAddresses(), tx.OutputAddresses()
+	for _, addr := range in_addrs {
+		add(addr)
+	}
+	for _, addr := range out_addrs {
+		add(addr)
+	}
+	if skip {
+		return
+	}
+	// rule1
+	for i := 1; i < len(in_addrs); i++ {
+		union(in_addrs[0], in_addrs[i], RuleMultiInput, nil)
+	}
+	// rule2
+	if tx.IsCoinbase() {
+		for i := 1; i < len(out_addrs); i++ {
+			union(out_addrs[0], out_addrs[i], RuleCoinbase, nil)
+		}
+	}
+	// rule3
+	if detector != nil && len(in_addrs) > 0 {
+		if change := detector.Detect(tx); change != nil {
+			if union(in_addrs[0], change.Address, RuleChange, change) {
+				detector.record(change)
+			}
+		}
+	}
+}
+
+// ClusterFrom clusters only txs which can link addresses to addr, found by
+// index, so the cluster of one address costs the degree of its members
+// rather than a pass over all txs. The cluster of addr is the one
+// ClusterAll gives.
+func ClusterFrom(addr string, txs []chain.Transaction, index *AddrIndex, detector *ChangeDetector, guard *CoinJoinGuard) *UnionFind {
+	u := NewUnionFind()
+	queued := map[string]bool{addr: true}
+	queue := []string{addr}
+	done := make(map[int]bool)
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, i := range index.Txs(next) {
+			if done[i] {
+				continue
+			}
+			done[i] = true
+			tx := &txs[i]
+			ClusterTx(u, tx, detector, guard)
+			// an address joining the cluster brings the set it had along
+			for _, a := range append(tx.InputAddresses(), tx.OutputAddresses()...) {
+				if queued[a] || !u.Same(a, addr) {
+					continue
+				}
+				for _, member := range u.ClusterOf(a) {
+					if !queued[member] {
+						queued[member] = true
+						queue = append(queue, member)
+					}
+				}
+			}
+		}
+	}
+	return u
+}
+
+// ClusterAll clusters every address of txs in one pass.
+func ClusterAll(txs []chain.Transaction, detector *ChangeDetector, guard *CoinJoinGuard) *UnionFind {
+	u := NewUnionFind()
+	for i := range txs {
+		ClusterTx(u, &txs[i], detector, guard)
+	}
+	return u
+}
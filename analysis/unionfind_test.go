@@ -0,0 +1,98 @@
+package analysis
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+func testTx(txid string, ins []string, outs ...string) chain.Transaction {
+	tx := chain.Transaction{Txid: txid}
+	for _, addr := range ins {
+		tx.Inputs = append(tx.Inputs, chain.TxInput{Txid: "prev", Address: addr, Value: 1000})
+	}
+	for _, addr := range outs {
+		tx.Outputs = append(tx.Outputs, chain.TxOutput{Address: addr, Value: 900})
+	}
+	return tx
+}
+
+func sorted(addrs []string) []string {
+	addrs = append([]string(nil), addrs...)
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestUnionFind(t *testing.T) {
+	u := NewUnionFind()
+	u.UnionAll([]string{"a", "b"})
+	u.UnionAll([]string{"c", "d", "e"})
+	u.Add("f")
+	if u.Same("a", "c") || !u.Same("c", "e") || u.Same("a", "zz") {
+		t.Fatal("Same is wrong before merging")
+	}
+	if !u.Union("b", "d") || u.Union("a", "e") {
+		t.Fatal("Union of sets merged twice")
+	}
+	if got := sorted(u.ClusterOf("e")); !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "e"}) || u.Size("a") != 5 {
+		t.Fatalf("cluster of e = %v", got)
+	}
+	if u.ClusterOf("zz") != nil || u.Size("zz") != 0 {
+		t.Fatal("unknown address has a cluster")
+	}
+	clusters := u.Clusters()
+	if len(clusters) != 2 || len(clusters[0]) != 5 || !reflect.DeepEqual(clusters[1], []string{"f"}) {
+		t.Fatalf("clusters = %v", clusters)
+	}
+}
+
+func TestClusterFrom(t *testing.T) {
+	txs := []chain.Transaction{
+		testTx("t0", []string{"x", "y"}, "s"), // x and y linked before the seed reaches them
+		testTx("t1", []string{"s", "a"}, "p"),
+		testTx("t2", []string{"p"}, "q"),
+		testTx("t3", []string{"a", "x"}, "r"), // links x, and y with it
+		testTx("t4", []string{"y", "z"}, "w"),
+		testTx("t5", []string{"m", "n"}, "o"),
+	}
+	index := BuildIndex(txs)
+	u := ClusterFrom("s", txs, index, nil, nil)
+	want := []string{"a", "s", "x", "y", "z"}
+	if got := sorted(u.ClusterOf("s")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("cluster of s = %v, want %v", got, want)
+	}
+	if u.Same("m", "n") {
+		t.Fatal("tx unreachable from the seed was clustered")
+	}
+	if u := ClusterFrom("nobody", txs, index, nil, nil); u.ClusterOf("nobody") != nil {
+		t.Fatal("address of no tx has a cluster")
+	}
+}
+
+// ClusterFrom gives the cluster ClusterAll gives, for every seed
+func TestClusterFromMatchesClusterAll(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	addr := func() string { return fmt.Sprintf("a%d", r.Intn(60)) }
+	var txs []chain.Transaction
+	for i := 0; i < 80; i++ {
+		ins := make([]string, 1+r.Intn(3))
+		for j := range ins {
+			ins[j] = addr()
+		}
+		txs = append(txs, testTx(fmt.Sprintf("t%d", i), ins, addr(), addr()))
+	}
+	detector := NewChangeDetector(txs, DefaultChangeOptions())
+	all := ClusterAll(txs, detector, nil)
+	index := BuildIndex(txs)
+	for _, members := range all.Clusters() {
+		seed := members[r.Intn(len(members))]
+		got := sorted(ClusterFrom(seed, txs, index, NewChangeDetector(txs, DefaultChangeOptions()), nil).ClusterOf(seed))
+		if want := sorted(members); !reflect.DeepEqual(got, want) {
+			t.Fatalf("cluster of %s = %v, want %v", seed, got, want)
+		}
+	}
+}
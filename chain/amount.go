@@ -0,0 +1,176 @@
+package chain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Amount is a value in satoshi.
+type Amount int64
+
+const (
+	Satoshi  Amount = 1
+	MilliBTC Amount = 100000
+	BTC      Amount = 100000000
+	// no more than 21 million bitcoins will ever exist
+	MaxMoney Amount = 21000000 * BTC
+)
+
+// units of Format and ParseAmount
+const (
+	UnitBTC      = "BTC"
+	UnitMilliBTC = "mBTC"
+	UnitSatoshi  = "sat"
+)
+
+func unitOf(unit string) (Amount, int, error) {
+	switch strings.ToLower(unit) {
+	case "btc":
+		return BTC, 8, nil
+	case "mbtc":
+		return MilliBTC, 5, nil
+	case "sat", "sats", "satoshi", "":
+		return Satoshi, 0, nil
+	}
+	return 0, 0, errors.New(fmt.Sprintf("unknown unit `%s`, should be BTC, mBTC or sat", unit))
+}
+
+// Valid is false for negative amounts and amounts above the supply cap.
+func (a Amount) Valid() bool {
+	return a >= 0 && a <= MaxMoney
+}
+
+func (a Amount) check() error {
+	if !a.Valid() {
+		return errors.New(fmt.Sprintf("amount %d sat out of range [0, %d]", int64(a), int64(MaxMoney)))
+	}
+	return nil
+}
+
+// Add returns a + b, both and the sum should be valid. As valid amounts are
+// far below the int64 limit the sum never overflows.
+func (a Amount) Add(b Amount) (Amount, error) {
+	if err := a.check(); err != nil {
+		return 0, err
+	}
+	if err := b.check(); err != nil {
+		return 0, err
+	}
+	sum := a + b
+	if err := sum.check(); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("%d + %d", int64(a), int64(b)))
+		return 0, err
+	}
+	return sum, nil
+}
+
+// Sub returns a - b, an error if b is greater than a.
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if err := a.check(); err != nil {
+		return 0, err
+	}
+	if err := b.check(); err != nil {
+		return 0, err
+	}
+	if b > a {
+		return 0, errors.New(fmt.Sprintf("%d - %d is negative", int64(a), int64(b)))
+	}
+	return a - b, nil
+}
+
+// Cmp is -1, 0 or 1 if a is less than, equal to or greater than b.
+func (a Amount) Cmp(b Amount) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Format writes a in unit: BTC, mBTC or sat, e.g. `0.00012000 BTC`.
+func (a Amount) Format(unit string) string {
+	size, decimals, err := unitOf(unit)
+	if err != nil {
+		size, decimals, unit = BTC, 8, UnitBTC
+	}
+	sign := ""
+	abs := a
+	if a < 0 {
+		sign, abs = "-", -a
+	}
+	if decimals == 0 {
+		return fmt.Sprintf("%s%d %s", sign, int64(abs), unit)
+	}
+	return fmt.Sprintf("%s%d.%0*d %s", sign, int64(abs/size), decimals, int64(abs%size), unit)
+}
+
+func (a Amount) String() string {
+	return a.Format(UnitBTC)
+}
+
+// ParseAmount reads amounts like `1.5 BTC`, `0.3mBTC` or `1000 sat`, a
+// number without unit is in satoshi. Digits beyond one satoshi are an error
+// rather than rounded.
+func ParseAmount(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "-") {
+		return 0, errors.New(fmt.Sprintf("invalid amount `%s`, should not be negative", s))
+	}
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.')
+	})
+	number, unit := s, ""
+	if i >= 0 {
+		number, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	size, decimals, err := unitOf(unit)
+	if err != nil {
+		return 0, err
+	}
+	whole, frac := number, ""
+	if j := strings.Index(number, "."); j >= 0 {
+		whole, frac = number[:j], number[j+1:]
+	}
+	if whole == "" && frac == "" || strings.Contains(frac, ".") {
+		return 0, errors.New(fmt.Sprintf("invalid amount `%s`", s))
+	}
+	if len(frac) > decimals {
+		return 0, errors.New(fmt.Sprintf("invalid amount `%s`, %s has at most %d decimals", s, unit, decimals))
+	}
+	var a Amount
+	if whole != "" {
+		n, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil || n > int64(MaxMoney/size) {
+			return 0, errors.New(fmt.Sprintf("invalid amount `%s`, above %s", s, MaxMoney))
+		}
+		a = Amount(n) * size
+	}
+	if frac != "" {
+		n, _ := strconv.ParseInt(frac+strings.Repeat("0", decimals-len(frac)), 10, 64)
+		a += Amount(n)
+	}
+	if err := a.check(); err != nil {
+		return 0, err
+	}
+	return a, nil
+}
+
+// UnmarshalJSON reads an integer satoshi value, rejecting values out of
+// range which only a corrupted file or a broken source gives.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	if err := Amount(n).check(); err != nil {
+		return err
+	}
+	*a = Amount(n)
+	return nil
+}
@@ -0,0 +1,94 @@
+package chain
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	for s, want := range map[string]Amount{
+		"1.5 BTC":         150000000,
+		"0.3mBTC":         30000,
+		"1000 sat":        1000,
+		"1000":            1000,
+		".5 btc":          50000000,
+		"5.":              5,
+		" 0.00000001BTC ": 1,
+		"21000000 BTC":    MaxMoney,
+		"0":               0,
+	} {
+		got, err := ParseAmount(s)
+		if err != nil || got != want {
+			t.Errorf("ParseAmount(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", ".", "-1", "1.2.3", "1 XBT", "0.000000001 BTC", "0.5 sat", "1.000001 mBTC",
+		"21000000.00000001 BTC", "21000001 BTC", "99999999999999999999"} {
+		if got, err := ParseAmount(s); err == nil {
+			t.Errorf("ParseAmount(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+func TestAmountFormat(t *testing.T) {
+	for _, c := range []struct {
+		amount Amount
+		unit   string
+		want   string
+	}{
+		{12000, UnitBTC, "0.00012000 BTC"},
+		{12000, UnitMilliBTC, "0.12000 mBTC"},
+		{12000, UnitSatoshi, "12000 sat"},
+		{MaxMoney, UnitBTC, "21000000.00000000 BTC"},
+		{-1, UnitBTC, "-0.00000001 BTC"},
+		{1, "XBT", "0.00000001 BTC"},
+	} {
+		if got := c.amount.Format(c.unit); got != c.want {
+			t.Errorf("%d in %s is %q, want %q", int64(c.amount), c.unit, got, c.want)
+		}
+		if c.amount.Valid() {
+			if back, err := ParseAmount(c.amount.Format(c.unit)); err != nil || back != c.amount {
+				t.Errorf("ParseAmount(%q) = %d, %v; want %d", c.amount.Format(c.unit), back, err, int64(c.amount))
+			}
+		}
+	}
+}
+
+func TestAmountUnmarshalJSON(t *testing.T) {
+	for raw, want := range map[string]Amount{"0": 0, "546": 546, "2100000000000000": MaxMoney} {
+		var a Amount
+		if err := json.Unmarshal([]byte(raw), &a); err != nil || a != want {
+			t.Errorf("unmarshal %s = %d, %v; want %d", raw, a, err, want)
+		}
+	}
+	for _, raw := range []string{"-1", "2100000000000001", "9223372036854775808", "1.5", "1e3", `"1"`} {
+		a := Amount(7)
+		if err := json.Unmarshal([]byte(raw), &a); err == nil || a != 7 {
+			t.Errorf("unmarshal %s = %d, %v; want an error and 7 unchanged", raw, a, err)
+		}
+	}
+}
+
+func TestAmountAddSub(t *testing.T) {
+	if sum, err := (MaxMoney - 1).Add(1); err != nil || sum != MaxMoney {
+		t.Errorf("MaxMoney-1 + 1 = %d, %v", sum, err)
+	}
+	if sum, err := MaxMoney.Add(1); err == nil {
+		t.Errorf("MaxMoney + 1 = %d, want an error", sum)
+	}
+	if sum, err := Amount(-1).Add(1); err == nil {
+		t.Errorf("-1 + 1 = %d, want an error", sum)
+	}
+	if diff, err := Amount(5).Sub(5); err != nil || diff != 0 {
+		t.Errorf("5 - 5 = %d, %v", diff, err)
+	}
+	if diff, err := Amount(5).Sub(6); err == nil {
+		t.Errorf("5 - 6 = %d, want an error", diff)
+	}
+	if diff, err := MaxMoney.Sub(MaxMoney + 1); err == nil {
+		t.Errorf("MaxMoney - (MaxMoney+1) = %d, want an error", diff)
+	}
+	if Amount(1).Cmp(2) != -1 || Amount(2).Cmp(2) != 0 || Amount(3).Cmp(2) != 1 {
+		t.Error("Cmp is wrong")
+	}
+}
@@ -0,0 +1,21 @@
+package chain
+
+// Block is a block header with txids of its transactions.
+type Block struct {
+	Hash      string   `json:"hash"`
+	Height    uint     `json:"height"`
+	Mainchain bool     `json:"mainchain"`
+	Previous  string   `json:"previous"`
+	Time      uint     `json:"time"`
+	Version   uint     `json:"version"`
+	Bits      uint     `json:"bits"`
+	Nonce     uint64   `json:"nonce"`
+	Size      uint     `json:"size"`
+	Tx        []string `json:"tx"`
+	Merkle    string   `json:"merkle"`
+	Subsidy   Amount   `json:"subsidy"`
+	Fees      Amount   `json:"fees"`
+	Outputs   uint64   `json:"outputs"`
+	// Work      uint64   `json:"work"`
+	Weight uint `json:"weight"`
+}
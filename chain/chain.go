@@ -0,0 +1,157 @@
+// Package chain holds blocks and transactions in the format of haskoin-store,
+// which the crawler saves into block files whatever source it downloads from.
+package chain
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// OutPoint names an output by the txid of its transaction and its index.
+type OutPoint struct {
+	Txid  string `json:"txid"`
+	Index uint   `json:"index"`
+}
+
+func (o OutPoint) String() string {
+	return fmt.Sprintf("%s:%d", o.Txid, o.Index)
+}
+
+type TxInput struct {
+	Coinbase  bool     `json:"coinbase"`
+	Txid      string   `json:"txid"`
+	Output    uint     `json:"output"`
+	Sigscript string   `json:"sigscript"`
+	Sequence  uint64   `json:"sequence"`
+	Pkscript  string   `json:"pkscript"`
+	Value     Amount   `json:"value"`
+	Address   string   `json:"address"`
+	Witness   []string `json:"witness"`
+}
+
+type TxOutput struct {
+	Address  string `json:"address"`
+	Pkscript string `json:"pkscript"`
+	Value    Amount `json:"value"`
+	Spent    bool   `json:"spent"`
+	Spender  struct {
+		Txid  string `json:"txid"`
+		Input uint   `json:"input"`
+	} `json:"spender,omitempty"`
+	Input uint `json:"input,omitempty"`
+}
+
+type Transaction struct {
+	Txid     string     `json:"txid"`
+	Size     uint       `json:"size"`
+	Version  uint       `json:"version"`
+	Locktime uint       `json:"locktime"`
+	Fee      Amount     `json:"fee"`
+	Inputs   []TxInput  `json:"inputs"`
+	Outputs  []TxOutput `json:"outputs"`
+	Block    struct {
+		Height   uint `json:"height"`
+		Position uint `json:"position"`
+	} `json:"block"`
+	Deleted bool `json:"deleted"`
+	Time    uint `json:"time"`
+	Rbf     bool `json:"rbf"`
+	Weight  uint `json:"weight"`
+}
+
+// Prevout is the output spent by in, empty for coinbase.
+func (in *TxInput) Prevout() OutPoint {
+	if in.Coinbase {
+		return OutPoint{}
+	}
+	return OutPoint{Txid: in.Txid, Index: in.Output}
+}
+
+// OutPoint names the i-th output of tx.
+func (tx *Transaction) OutPoint(i int) OutPoint {
+	return OutPoint{Txid: tx.Txid, Index: uint(i)}
+}
+
+func (tx *Transaction) IsCoinbase() bool {
+	return len(tx.Inputs) > 0 && tx.Inputs[0].Coinbase
+}
+
+// InputAddresses lists addresses of inputs in order, inputs without an
+// address like coinbase are skipped.
+func (tx *Transaction) InputAddresses() []string {
+	var addrs []string
+	for _, in := range tx.Inputs {
+		if in.Address != "" {
+			addrs = append(addrs, in.Address)
+		}
+	}
+	return addrs
+}
+
+// OutputAddresses lists addresses of outputs in order, outputs without an
+// address like OP_RETURN are skipped.
+func (tx *Transaction) OutputAddresses() []string {
+	var addrs []string
+	for _, out := range tx.Outputs {
+		if out.Address != "" {
+			addrs = append(addrs, out.Address)
+		}
+	}
+	return addrs
+}
+
+func (tx *Transaction) TotalIn() (Amount, error) {
+	var total Amount
+	for _, in := range tx.Inputs {
+		var err error
+		if total, err = total.Add(in.Value); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("inputs of tx %s", tx.Txid))
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func (tx *Transaction) TotalOut() (Amount, error) {
+	var total Amount
+	for _, out := range tx.Outputs {
+		var err error
+		if total, err = total.Add(out.Value); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("outputs of tx %s", tx.Txid))
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// ComputedFee is inputs minus outputs, which should equal Fee given by the
+// source. Coinbase pays no fee.
+func (tx *Transaction) ComputedFee() (Amount, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+	in, err := tx.TotalIn()
+	if err != nil {
+		return 0, err
+	}
+	out, err := tx.TotalOut()
+	if err != nil {
+		return 0, err
+	}
+	fee, err := in.Sub(out)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("tx %s spends %s but outputs %s", tx.Txid, in, out))
+		return 0, err
+	}
+	return fee, nil
+}
+
+// VSize is the virtual size in vbytes, weight / 4 rounded up, or the size
+// if weight is not given.
+func (tx *Transaction) VSize() uint {
+	if tx.Weight == 0 {
+		return tx.Size
+	}
+	return (tx.Weight + 3) / 4
+}
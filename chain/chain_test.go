@@ -0,0 +1,133 @@
+package chain
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// a p2wpkh spend with rbf, in the format of haskoin-store
+const segwitTx = `{"txid":"d869f854e1f8788bcff294cc83b280942a8c728de71eb709a2c29d10bfe21b7c","size":222,"version":2,"locktime":0,"fee":14100,
+"inputs":[{"coinbase":false,"txid":"8a4b3e8e2e4e9b2e7e1f03a5b5a3b9b0c4b7f6fdbf51ec2f4f8fe4d2c7b3a1e0","output":1,"sigscript":"","sequence":4294967293,
+"pkscript":"0014751e76e8199196d454941c45d1b3a323f1433bd6","value":1014100,"address":"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+"witness":["3044022066a0c1ea2d7bb6b6c5e6a19f8e1c1a1d5f8bba6d3e5f9ec5e7c1b0f2a8b2b6f002202a6e3b9c5f0b7a7e8c5d9a3b6f1e2c4d5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d01","0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"]}],
+"outputs":[{"address":"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2","pkscript":"76a91477bff20c60e522dfaa3350c39b030a5d004e839a88ac","value":1000000,"spent":false}],
+"block":{"height":700000,"position":12},"deleted":false,"time":1631333672,"rbf":true,"weight":561}`
+
+func readFixture(t *testing.T, name string, v interface{}) []byte {
+	content, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		t.Fatalf("unmarshal %s: %v", name, err)
+	}
+	return content
+}
+
+// roundTrip marshals v, checks every key of orig is written again and
+// unmarshals the result into a new value of v's type.
+func roundTrip(t *testing.T, orig []byte, v interface{}) interface{} {
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after interface{}
+	json.Unmarshal(orig, &before)
+	json.Unmarshal(out, &after)
+	sameKeys(t, "", before, after)
+	again := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+	if err := json.Unmarshal(out, again); err != nil {
+		t.Fatalf("unmarshal %s: %v", out, err)
+	}
+	return again
+}
+
+// sameKeys reports keys of haskoin json missing from ours
+func sameKeys(t *testing.T, path string, want, got interface{}) {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			t.Errorf("%s is %T, want an object", path, got)
+			return
+		}
+		for key, value := range w {
+			if _, ok := g[key]; !ok {
+				t.Errorf("key %s.%s is not written", path, key)
+				continue
+			}
+			sameKeys(t, path+"."+key, value, g[key])
+		}
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			t.Errorf("%s is %v, want %d items", path, got, len(w))
+			return
+		}
+		for i := range w {
+			sameKeys(t, path, w[i], g[i])
+		}
+	}
+}
+
+func TestBlockJSON(t *testing.T) {
+	var block Block
+	orig := readFixture(t, "block_170.json", &block)
+	if block.Height != 170 || block.Bits != 0x1d00ffff || block.Nonce != 1889418792 || len(block.Tx) != 2 ||
+		block.Subsidy != 50*BTC || block.Fees != 0 || block.Outputs != 10000000000 || !block.Mainchain {
+		t.Fatalf("block = %+v", block)
+	}
+	again := roundTrip(t, orig, &block)
+	if !reflect.DeepEqual(again, &block) {
+		t.Fatalf("round trip = %+v, want %+v", again, block)
+	}
+}
+
+func TestTransactionJSON(t *testing.T) {
+	var txs []Transaction
+	orig := readFixture(t, "txs_170.json", &txs)
+	coinbase, tx := txs[0], txs[1]
+	if !coinbase.IsCoinbase() || coinbase.Inputs[0].Output != 4294967295 || coinbase.Inputs[0].Pkscript != "" ||
+		coinbase.Inputs[0].Address != "" || coinbase.Outputs[0].Value != 50*BTC {
+		t.Fatalf("coinbase = %+v", coinbase)
+	}
+	if tx.IsCoinbase() || tx.Inputs[0].Prevout().String() != "0437cd7f8525ceed2324359c2d0ba26006d92d856a9c20fa0241106ee5a597c9:0" ||
+		tx.Outputs[0].Value != 10*BTC || !tx.Outputs[0].Spent || tx.Outputs[0].Spender.Txid != "ea44e97271691990157559d0bdd9959e02790c34db6c006d779e82fa5aee708e" ||
+		tx.Block.Height != 170 || tx.Block.Position != 1 {
+		t.Fatalf("tx = %+v", tx)
+	}
+	if fee, err := tx.ComputedFee(); err != nil || fee != tx.Fee {
+		t.Fatalf("computed fee %s, %v; want %s", fee, err, tx.Fee)
+	}
+	again := roundTrip(t, orig, &txs)
+	if !reflect.DeepEqual(again, &txs) {
+		t.Fatalf("round trip = %+v, want %+v", again, txs)
+	}
+
+	var segwit Transaction
+	if err := json.Unmarshal([]byte(segwitTx), &segwit); err != nil {
+		t.Fatal(err)
+	}
+	if len(segwit.Inputs[0].Witness) != 2 || !segwit.Rbf || segwit.VSize() != 141 || segwit.InputAddresses()[0] != segwit.Inputs[0].Address {
+		t.Fatalf("segwit tx = %+v", segwit)
+	}
+	if fee, err := segwit.ComputedFee(); err != nil || fee != 14100 {
+		t.Fatalf("computed fee %s, %v; want 14100 sat", fee, err)
+	}
+	again = roundTrip(t, []byte(segwitTx), &segwit)
+	if !reflect.DeepEqual(again, &segwit) {
+		t.Fatalf("round trip = %+v, want %+v", again, segwit)
+	}
+}
+
+func TestTransactionJSONRejectsBadValues(t *testing.T) {
+	for _, value := range []string{"-1", "2100000000000001", "1.5", `"1000"`} {
+		raw := `{"txid":"t","inputs":[],"outputs":[{"address":"1A","value":` + value + `}]}`
+		var tx Transaction
+		if err := json.Unmarshal([]byte(raw), &tx); err == nil {
+			t.Errorf("output value %s accepted as %s", value, tx.Outputs[0].Value)
+		}
+	}
+}
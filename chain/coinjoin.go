@@ -0,0 +1,134 @@
+package chain
+
+// kinds of CoinJoin told by DetectCoinJoin
+const (
+	CoinJoinWhirlpool  = "whirlpool"
+	CoinJoinWasabi     = "wasabi"
+	CoinJoinJoinMarket = "joinmarket"
+	CoinJoinGeneric    = "generic"
+)
+
+// pool denominations of Whirlpool, its mixes have 5 inputs and 5 outputs
+var whirlpoolPools = []Amount{100000, 1000000, 5000000, 50000000}
+
+const (
+	whirlpoolSize = 5
+	// Wasabi 1 rounds have many outputs of about 0.1 BTC, or of doubles of it
+	// for higher mixing levels
+	wasabiMinEqual = 10
+	wasabiBase     = BTC / 10
+	// Wasabi 2 rounds are large and use many denominations, each shared by
+	// several outputs
+	wabiSabiMinSize  = 50
+	wabiSabiMinEqual = 5
+	// other CoinJoins mix at least 3 owners, fewer equal outputs are
+	// ordinary payments
+	minEqual        = 3
+	minParticipants = 3
+)
+
+// CoinJoin is a tx where several owners pay into outputs of equal value,
+// so which input paid which of them can not be told. Its inputs do not
+// share an owner.
+type CoinJoin struct {
+	Txid    string `json:"txid"`
+	Height  uint   `json:"height"`
+	Kind    string `json:"kind"`
+	Value   Amount `json:"value"` // value of the equal outputs
+	Equal   int    `json:"equal"` // number of the equal outputs
+	Inputs  int    `json:"inputs"`
+	Outputs int    `json:"outputs"`
+}
+
+// equalOutputs returns the value most outputs have and how many, the
+// larger value if two are as common, and how many outputs share their
+// value with another output.
+func (tx *Transaction) equalOutputs() (Amount, int, int) {
+	counts := make(map[Amount]int)
+	var value Amount
+	equal := 0
+	for _, out := range tx.Outputs {
+		if out.Value == 0 {
+			continue
+		}
+		counts[out.Value]++
+		n := counts[out.Value]
+		if n > equal || n == equal && out.Value > value {
+			value, equal = out.Value, n
+		}
+	}
+	repeated := 0
+	for _, n := range counts {
+		if n > 1 {
+			repeated += n
+		}
+	}
+	return value, equal, repeated
+}
+
+// DetectCoinJoin tells whether tx looks like a CoinJoin, nil if not. The
+// kinds are checked in order:
+//
+//   - whirlpool: 5 inputs, 5 outputs all of a pool denomination
+//   - wasabi: at least 10 equal outputs of about 0.1 BTC times a power of 2,
+//     or at least 50 inputs and 50 outputs, most of them sharing their value
+//     with another output and at least 5 of one value
+//   - joinmarket: at least 3 equal outputs and at most one change output
+//     for each
+//   - generic: at least 3 equal outputs, a third of the outputs or more
+//
+// Every kind needs at least 3 input addresses, and as many as equal
+// outputs, as each of them is paid by a different owner. Two equal outputs
+// are not enough, payments often have them.
+func (tx *Transaction) DetectCoinJoin() *CoinJoin {
+	if tx.IsCoinbase() || len(tx.Inputs) < minParticipants || len(tx.Outputs) < minEqual {
+		return nil
+	}
+	value, equal, repeated := tx.equalOutputs()
+	if equal < minEqual {
+		return nil
+	}
+	owners := make(map[string]bool)
+	for _, addr := range tx.InputAddresses() {
+		owners[addr] = true
+	}
+	if len(owners) < minParticipants || len(owners) < equal {
+		return nil
+	}
+	cj := &CoinJoin{Txid: tx.Txid, Height: tx.Block.Height, Value: value, Equal: equal,
+		Inputs: len(tx.Inputs), Outputs: len(tx.Outputs)}
+	switch {
+	case len(tx.Inputs) == whirlpoolSize && len(tx.Outputs) == whirlpoolSize && equal == whirlpoolSize && isWhirlpoolPool(value):
+		cj.Kind = CoinJoinWhirlpool
+	case equal >= wasabiMinEqual && isWasabiLevel(value),
+		len(tx.Inputs) >= wabiSabiMinSize && len(tx.Outputs) >= wabiSabiMinSize && equal >= wabiSabiMinEqual && 2*repeated >= len(tx.Outputs):
+		cj.Kind = CoinJoinWasabi
+	case len(tx.Outputs) <= 2*equal:
+		cj.Kind = CoinJoinJoinMarket
+	case 3*equal >= len(tx.Outputs):
+		cj.Kind = CoinJoinGeneric
+	default:
+		return nil
+	}
+	return cj
+}
+
+func isWhirlpoolPool(value Amount) bool {
+	for _, pool := range whirlpoolPools {
+		if value == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// isWasabiLevel tells whether value is within 10% of 0.1 BTC times a
+// power of 2
+func isWasabiLevel(value Amount) bool {
+	for level := wasabiBase; level <= MaxMoney; level *= 2 {
+		if value >= level-level/10 && value <= level+level/10 {
+			return true
+		}
+	}
+	return false
+}
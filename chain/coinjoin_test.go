@@ -0,0 +1,102 @@
+package chain
+
+import (
+	"fmt"
+	"testing"
+)
+
+// mixTx has an input of each of owners addresses and outputs of values
+func mixTx(owners int, inputs int, values ...Amount) *Transaction {
+	tx := &Transaction{Txid: "t"}
+	for i := 0; i < inputs; i++ {
+		tx.Inputs = append(tx.Inputs, TxInput{Txid: "prev", Output: uint(i), Address: fmt.Sprintf("in%d", i%owners), Value: BTC})
+	}
+	for i, value := range values {
+		tx.Outputs = append(tx.Outputs, TxOutput{Address: fmt.Sprintf("out%d", i), Value: value})
+	}
+	return tx
+}
+
+// n outputs of value
+func times(n int, value Amount) []Amount {
+	values := make([]Amount, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+// n outputs of distinct values above base
+func distinct(n int, base Amount) []Amount {
+	values := make([]Amount, n)
+	for i := range values {
+		values[i] = base + Amount(i)*1234
+	}
+	return values
+}
+
+func join(groups ...[]Amount) []Amount {
+	var values []Amount
+	for _, g := range groups {
+		values = append(values, g...)
+	}
+	return values
+}
+
+func TestDetectCoinJoin(t *testing.T) {
+	// wabisabi denominations, each used a few times
+	var wabiSabi []Amount
+	for _, d := range []Amount{5000, 6561, 10000, 19683, 20000, 50000, 59049, 100000, 177147, 200000, 500000, 531441} {
+		wabiSabi = append(wabiSabi, times(5, d)...)
+	}
+	for _, c := range []struct {
+		name string
+		tx   *Transaction
+		kind string // empty if not a CoinJoin
+	}{
+		{"whirlpool", mixTx(5, 5, times(5, 1000000)...), CoinJoinWhirlpool},
+		{"wasabi 1", mixTx(60, 70, join(times(40, 10010000), distinct(25, 3000000))...), CoinJoinWasabi},
+		{"wasabi 1 doubled level", mixTx(15, 15, join(times(12, 20000000), distinct(3, 100000))...), CoinJoinWasabi},
+		{"wabisabi", mixTx(70, 80, join(wabiSabi, distinct(10, 700000))...), CoinJoinWasabi},
+		{"joinmarket", mixTx(4, 4, join(times(4, 12345678), distinct(3, 500000))...), CoinJoinJoinMarket},
+		{"joinmarket without change", mixTx(3, 3, times(3, 2000000)...), CoinJoinJoinMarket},
+		{"generic", mixTx(6, 6, join(times(4, 777777), distinct(6, 10000))...), CoinJoinGeneric},
+
+		{"payment with change", mixTx(1, 1, 500000, 1234567), ""},
+		{"2 owners, 2 equal outputs", mixTx(2, 2, 500000, 500000), ""},
+		{"3 outputs, 2 equal payouts", mixTx(2, 2, 500000, 500000, 1234567), ""},
+		{"4 outputs, 2 equal payouts", mixTx(3, 3, 500000, 500000, 1234567, 7654321), ""},
+		{"one owner, equal outputs", mixTx(1, 5, times(5, 1000000)...), ""},
+		{"fewer owners than equal outputs", mixTx(3, 6, times(4, 1000000)...), ""},
+		{"consolidation", mixTx(80, 80, 79000000), ""},
+		{"exchange batch payout", mixTx(60, 60, join(times(3, 1000000), distinct(57, 2000000))...), ""},
+		{"exchange batch, some equal withdrawals", mixTx(60, 60, join(times(2, 1000000), times(2, 5000000), times(2, 100000), distinct(54, 2000000))...), ""},
+		{"batch of a few owners", mixTx(2, 2, join(times(6, 1000000), distinct(4, 2000000))...), ""},
+	} {
+		cj := c.tx.DetectCoinJoin()
+		switch {
+		case c.kind == "" && cj != nil:
+			t.Errorf("%s: detected as %s coinjoin of %d equal outputs", c.name, cj.Kind, cj.Equal)
+		case c.kind != "" && cj == nil:
+			t.Errorf("%s: not detected, want %s", c.name, c.kind)
+		case c.kind != "" && cj.Kind != c.kind:
+			t.Errorf("%s: detected as %s, want %s", c.name, cj.Kind, c.kind)
+		}
+	}
+}
+
+func TestDetectCoinJoinFields(t *testing.T) {
+	tx := mixTx(5, 5, times(5, 5000000)...)
+	tx.Txid = "mix"
+	tx.Block.Height = 700000
+	cj := tx.DetectCoinJoin()
+	if cj == nil || cj.Txid != "mix" || cj.Height != 700000 || cj.Value != 5000000 || cj.Equal != 5 || cj.Inputs != 5 || cj.Outputs != 5 {
+		t.Fatalf("coinjoin = %+v", cj)
+	}
+
+	coinbase := mixTx(5, 5, times(5, 5000000)...)
+	coinbase.Inputs[0].Coinbase = true
+	if cj := coinbase.DetectCoinJoin(); cj != nil {
+		t.Fatalf("coinbase detected as %+v", cj)
+	}
+}
@@ -0,0 +1,207 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	cli "github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Settings are taken in this order, the first one set wins:
+//  1. command line flags
+//  2. environment variables GO_LEARN_<SECTION>_<KEY>, e.g. GO_LEARN_CRAWLER_SAVEDIR
+//  3. config file given by --config or GO_LEARN_CONFIG, otherwise
+//     go_learn.{yaml,yml,toml} in the working directory or ~/.config/go_learn/
+//  4. defaults below
+const (
+	EnvPrefix = "GO_LEARN"
+	EnvConfig = "GO_LEARN_CONFIG"
+	FileName  = "go_learn"
+)
+
+// keys are `<section>.<flag name>` with `-` replaced by `_`, or just the
+// flag name for global flags, so flags of a command are bound to keys by name.
+var defaults = map[string]interface{}{
+	"log_level": "info",
+	"data_dir":  "",
+
+	"crawler.source":          "haskoin",
+	"crawler.url":             "",
+	"crawler.rpc_user":        "",
+	"crawler.rpc_password":    "",
+	"crawler.rpc_cookie":      "",
+	"crawler.page":            10,
+	"crawler.ua_path":         "",
+	"crawler.ua_strategy":     "random",
+	"crawler.proxy_path":      "",
+	"crawler.proxy_strategy":  "score",
+	"crawler.proxy_cooldown":  5 * time.Minute,
+	"crawler.savedir":         "result",
+	"crawler.format":          "json",
+	"crawler.compress":        "none",
+	"crawler.workers":         4,
+	"crawler.rate":            1.0,
+	"crawler.burst":           3,
+	"crawler.host_rate":       []string{},
+	"crawler.retries":         6,
+	"crawler.retry_delay":     2 * time.Second,
+	"crawler.retry_max_delay": 2 * time.Minute,
+	"crawler.timeout":         time.Minute,
+
+	"analysis.dataset_path":     "",
+	"analysis.change_signals":   []string{"fresh", "address_type", "non_round=0.5", "unnecessary_input"},
+	"analysis.change_threshold": 1.5,
+	"analysis.index":            "",
+	"analysis.cluster_db":       "",
+	"analysis.coinjoin":         "skip",
+
+	"graph.uri":      "neo4j://localhost:7687",
+	"graph.user":     "neo4j",
+	"graph.password": "test",
+}
+
+// data_dir is the default of these, which name where block files are
+var dataDirKeys = []string{"crawler.savedir", "analysis.dataset_path"}
+
+// New returns a viper holding the defaults and reading environment
+// variables, config files are read by Load.
+func New() *viper.Viper {
+	v := viper.New()
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	return v
+}
+
+// Load reads config file at path, or the one named by GO_LEARN_CONFIG, or
+// searches the default locations if both are empty. No config file found
+// in default locations is fine.
+func Load(v *viper.Viper, path string) error {
+	if path == "" {
+		path = os.Getenv(EnvConfig)
+	}
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("read config file `%s` failed", path))
+			return err
+		}
+		return nil
+	}
+	v.SetConfigName(FileName)
+	v.AddConfigPath(".")
+	if home, err := os.UserHomeDir(); err == nil {
+		v.AddConfigPath(filepath.Join(home, ".config", FileName))
+	}
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			return nil
+		}
+		err = errors.Wrap(err, "read config file failed")
+		return err
+	}
+	return nil
+}
+
+// Bind sets flags of cmd not given on command line from their keys, so
+// variables behind flags hold the effective settings. Flags given on
+// command line are set into v. Global keys are bound first, as data_dir is
+// the default of other keys.
+func Bind(v *viper.Viper, cmd *cli.Command) error {
+	var global, sections []string
+	for key := range defaults {
+		if strings.Contains(key, ".") {
+			sections = append(sections, key)
+		} else {
+			global = append(global, key)
+		}
+	}
+	for _, key := range global {
+		if err := bindKey(v, cmd, key); err != nil {
+			return err
+		}
+	}
+	if dir := v.GetString("data_dir"); dir != "" {
+		for _, key := range dataDirKeys {
+			v.SetDefault(key, dir)
+		}
+	}
+	for _, key := range sections {
+		if err := bindKey(v, cmd, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bindKey(v *viper.Viper, cmd *cli.Command, key string) error {
+	name := key[strings.LastIndex(key, ".")+1:]
+	// flags are named like `retry-delay` or `dataset_path`
+	flag := cmd.Flags().Lookup(strings.ReplaceAll(name, "_", "-"))
+	if flag == nil {
+		flag = cmd.Flags().Lookup(name)
+	}
+	if flag == nil {
+		return nil
+	}
+	if flag.Changed {
+		v.Set(key, flag.Value.String())
+		return nil
+	}
+	value := v.GetString(key)
+	if _, ok := defaults[key].([]string); ok {
+		value = strings.Join(v.GetStringSlice(key), ",")
+	}
+	if err := flag.Value.Set(value); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("invalid value `%s` of %s", value, key))
+		return err
+	}
+	return nil
+}
+
+// Show prints every setting as `key = value`, passwords are masked.
+func Show(v *viper.Viper, w io.Writer) {
+	if file := v.ConfigFileUsed(); file != "" {
+		fmt.Fprintf(w, "# config file: %s\n", file)
+	} else {
+		fmt.Fprintln(w, "# config file: none")
+	}
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := v.Get(key)
+		if strings.HasSuffix(key, "password") && v.GetString(key) != "" {
+			value = "******"
+		}
+		fmt.Fprintf(w, "%s = %v\n", key, value)
+	}
+}
+
+// ShowCommand is `config show` printing the effective config of v, which
+// is loaded by the persistent pre-run of the root command.
+func ShowCommand(v *viper.Viper) *cli.Command {
+	var configCmd = &cli.Command{
+		Use:   "config",
+		Short: "inspect configuration",
+	}
+	var showCmd = &cli.Command{
+		Use:   "show",
+		Short: "print the effective config from environment, config file and defaults",
+		Args:  cli.NoArgs,
+		Run: func(cmd *cli.Command, args []string) {
+			Show(v, os.Stdout)
+		},
+	}
+	configCmd.AddCommand(showCmd)
+	return configCmd
+}
@@ -0,0 +1,178 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// formats and compressions of block files saved by the crawler
+const (
+	FormatJSON  = "json"  // one json array of txs
+	FormatJSONL = "jsonl" // one tx per line
+
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// BlockExt returns the file extension of given format and compression,
+// such as `.json` or `.jsonl.zst`.
+func BlockExt(format string, compress string) (string, error) {
+	var ext string
+	switch format {
+	case FormatJSON, FormatJSONL:
+		ext = "." + format
+	default:
+		return "", errors.New(fmt.Sprintf("unknown format `%s`, expect json or jsonl", format))
+	}
+	switch compress {
+	case CompressNone, "":
+	case CompressGzip:
+		ext += ".gz"
+	case CompressZstd:
+		ext += ".zst"
+	default:
+		return "", errors.New(fmt.Sprintf("unknown compression `%s`, expect none, gzip or zstd", compress))
+	}
+	return ext, nil
+}
+
+// IsBlockFile tells whether name is a block file saved by the crawler in
+// any format, unfinished `.part` and `.tmp` files are not.
+func IsBlockFile(name string) bool {
+	if !strings.HasPrefix(name, "block_height=") {
+		return false
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".zst")
+	return strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".jsonl")
+}
+
+// BlockHeight returns the height in the name of a block file, like 42 of
+// `block_height=42.json.gz`.
+func BlockHeight(name string) (uint, bool) {
+	if !IsBlockFile(name) {
+		return 0, false
+	}
+	name = strings.TrimPrefix(name, "block_height=")
+	height, err := strconv.ParseUint(name[:strings.Index(name, ".")], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint(height), true
+}
+
+// NewWriter compresses what is written to w, Close flushes the compressor
+// but does not close w.
+func NewWriter(w io.Writer, compress string) (io.WriteCloser, error) {
+	switch compress {
+	case CompressNone, "":
+		return nopCloser{w}, nil
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			err = errors.Wrap(err, "create zstd writer failed")
+			return nil, err
+		}
+		return enc, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown compression `%s`, expect none, gzip or zstd", compress))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// OpenBlock opens a block file, gzip and zstd are detected by magic number
+// and decompressed on the fly.
+func OpenBlock(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read file: %s error", path))
+		return nil, err
+	}
+	reader := bufio.NewReader(f)
+	magic, _ := reader.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			f.Close()
+			err = errors.Wrap(err, fmt.Sprintf("open gzip file: %s error", path))
+			return nil, err
+		}
+		return &readCloser{gz, func() error { gz.Close(); return f.Close() }}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		dec, err := zstd.NewReader(reader)
+		if err != nil {
+			f.Close()
+			err = errors.Wrap(err, fmt.Sprintf("open zstd file: %s error", path))
+			return nil, err
+		}
+		return &readCloser{dec, func() error { dec.Close(); return f.Close() }}, nil
+	}
+	return &readCloser{reader, f.Close}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// ReadBlock reads a block file in any format and compression and returns
+// its txs as one json array, ready for json.Unmarshal.
+func ReadBlock(path string) ([]byte, error) {
+	r, err := OpenBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read file: %s error", path))
+		return nil, err
+	}
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 || content[0] == '[' {
+		return content, nil
+	}
+	// json lines, join them into an array
+	var buf bytes.Buffer
+	buf.Grow(len(content) + 2)
+	buf.WriteByte('[')
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(line)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
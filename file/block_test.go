@@ -0,0 +1,135 @@
+package file
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// block file of txs written like the crawler does in format and compress
+func writeBlockFile(t *testing.T, path string, format string, compress string, txs []string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := NewWriter(f, compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "[" + strings.Join(txs, ",") + "]"
+	if format == FormatJSONL {
+		content = strings.Join(txs, "\n") + "\n"
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBlock(t *testing.T) {
+	txs := []string{`{"txid":"a","size":1}`, `{"txid":"b","size":2}`, `{"txid":"c","size":3}`}
+	for _, format := range []string{FormatJSON, FormatJSONL} {
+		for _, compress := range []string{CompressNone, CompressGzip, CompressZstd} {
+			ext, err := BlockExt(format, compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "block_height=7"+ext)
+			writeBlockFile(t, path, format, compress, txs)
+			content, err := ReadBlock(path)
+			if err != nil {
+				t.Fatalf("%s %s: %v", format, compress, err)
+			}
+			var got []struct {
+				Txid string `json:"txid"`
+				Size int    `json:"size"`
+			}
+			if err := json.Unmarshal(content, &got); err != nil {
+				t.Fatalf("%s %s: %v in %s", format, compress, err, content)
+			}
+			if len(got) != 3 || got[0].Txid != "a" || got[1].Size != 2 || got[2].Txid != "c" {
+				t.Errorf("%s %s: read %+v", format, compress, got)
+			}
+		}
+	}
+}
+
+func TestOpenBlockMagic(t *testing.T) {
+	// compression is told by content, not by the extension
+	for _, compress := range []string{CompressNone, CompressGzip, CompressZstd} {
+		path := filepath.Join(t.TempDir(), "block_height=7.json")
+		writeBlockFile(t, path, FormatJSON, compress, []string{`{"txid":"a"}`})
+		content, err := ReadBlock(path)
+		if err != nil {
+			t.Fatalf("%s: %v", compress, err)
+		}
+		if string(content) != `[{"txid":"a"}]` {
+			t.Errorf("%s: read %q", compress, content)
+		}
+	}
+
+	empty := filepath.Join(t.TempDir(), "block_height=7.json")
+	if err := os.WriteFile(empty, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ReadBlock(empty); err != nil || len(content) != 0 {
+		t.Errorf("empty file: %q, %v", content, err)
+	}
+	if _, err := ReadBlock(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestBlockExt(t *testing.T) {
+	tests := []struct {
+		format, compress, ext string
+	}{
+		{FormatJSON, CompressNone, ".json"},
+		{FormatJSON, "", ".json"},
+		{FormatJSONL, CompressGzip, ".jsonl.gz"},
+		{FormatJSON, CompressZstd, ".json.zst"},
+	}
+	for _, test := range tests {
+		ext, err := BlockExt(test.format, test.compress)
+		if err != nil || ext != test.ext {
+			t.Errorf("%s %s: %q, %v; want %q", test.format, test.compress, ext, err, test.ext)
+		}
+	}
+	if _, err := BlockExt("csv", CompressNone); err == nil {
+		t.Error("csv: no error")
+	}
+	if _, err := BlockExt(FormatJSON, "bzip2"); err == nil {
+		t.Error("bzip2: no error")
+	}
+	if _, err := NewWriter(nil, "bzip2"); err == nil {
+		t.Error("writer of bzip2: no error")
+	}
+}
+
+func TestBlockHeight(t *testing.T) {
+	tests := []struct {
+		name   string
+		height uint
+		ok     bool
+	}{
+		{"block_height=42.json", 42, true},
+		{"block_height=42.jsonl.gz", 42, true},
+		{"block_height=0.json.zst", 0, true},
+		{"block_height=42.json.part", 0, false},
+		{"block_height=42.json.tmp", 0, false},
+		{"block_height=x.json", 0, false},
+		{"headers.jsonl", 0, false},
+	}
+	for _, test := range tests {
+		height, ok := BlockHeight(test.name)
+		if height != test.height || ok != test.ok {
+			t.Errorf("%s: %d, %v; want %d, %v", test.name, height, ok, test.height, test.ok)
+		}
+	}
+}
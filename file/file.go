@@ -1,8 +1,12 @@
 package file
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
 )
 
 func ReadFile(path string) ([]byte, error) {
@@ -26,3 +30,27 @@ func ListDir(path string) ([]string, error) {
 	}
 	return res, nil
 }
+
+func Save(path string, content []byte, flag int) error {
+	// check path exists
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		dir := filepath.Dir(path)
+		os.MkdirAll(dir, 0766)
+	}
+	// open or create file for writing
+	file, err := os.OpenFile(path, flag, 0666)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Open file `%s` error", path))
+		return err
+	}
+	defer file.Close()
+	// write content
+	writer := bufio.NewWriter(file)
+	_, err = writer.Write(content)
+	writer.Flush()
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("save file `%s` error", path))
+		return err
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ require (
 	github.com/cpuguy83/go-md2man v1.0.10 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
 	github.com/kevin2li/go_learn/container_learn v0.0.0-20211202121929-90a5629f6a1e
+	github.com/klauspost/compress v1.13.6
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/neo4j/neo4j-go-driver/v4 v4.4.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
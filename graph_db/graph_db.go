@@ -1,62 +1,27 @@
-package main
+package graph_db
 
 import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/kevin2li/go_learn/utils"
 	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
 	"github.com/pkg/errors"
-	pb "github.com/schollz/progressbar/v3"
+	cli "github.com/spf13/cobra"
 )
 
-type Transaction struct {
-	Txid     string `json:"txid"`
-	Size     uint   `json:"size"`
-	Version  uint   `json:"version"`
-	Locktime uint   `json:"locktime"`
-	Fee      uint   `json:"fee"`
-	Inputs   []struct {
-		Coinbase  bool     `json:"coinbase"`
-		Txid      string   `json:"txid"`
-		Output    uint     `json:"output"`
-		Sigscript string   `json:"sigscript"`
-		Sequence  uint64   `json:"sequence"`
-		Pkscript  string   `json:"pkscript"`
-		Value     uint     `json:"value"`
-		Address   string   `json:"address"`
-		Witness   []string `json:"witness"`
-	} `json:"inputs"`
-	Outputs []struct {
-		Address  string `json:"address"`
-		Pkscript string `json:"pkscript"`
-		Value    uint   `json:"value"`
-		Spent    bool   `json:"spent"`
-		Spender  struct {
-			Txid  string `json:"txid"`
-			Input uint   `json:"input"`
-		} `json:"spender,omitempty"`
-		Input uint `json:"input,omitempty"`
-	} `json:"outputs"`
-	Block struct {
-		Height   uint `json:"height"`
-		Position uint `json:"position"`
-	} `json:"block"`
-	Deleted bool `json:"deleted"`
-	Time    uint `json:"time"`
-	Rbf     bool `json:"rbf"`
-	Weight  uint `json:"weight"`
-}
-
 type Params = map[string]interface{}
 
-func ReadTransaction(path string) ([]Transaction, error) {
-	var txs []Transaction
-	obj, err := os.ReadFile(path)
+// ReadTransaction reads a block file saved by the crawler, json array or
+// json lines, plain or compressed with gzip or zstd.
+func ReadTransaction(path string) ([]chain.Transaction, error) {
+	var txs []chain.Transaction
+	obj, err := fs.ReadBlock(path)
 	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("read file: %s error", path))
 		return nil, err
 	}
 	err = json.Unmarshal(obj, &txs)
@@ -67,43 +32,23 @@ func ReadTransaction(path string) ([]Transaction, error) {
 	return txs, nil
 }
 
-func GetTxInAddrs(tx Transaction) []string {
-	var in_addrs []string
-	for _, utxo := range tx.Inputs {
-		if utxo.Address != "" {
-			in_addrs = append(in_addrs, utxo.Address)
-		}
-	}
-	return in_addrs
-}
-
-func GetTxOutAddrs(tx Transaction) []string {
-	var out_addrs []string
-	for _, utxo := range tx.Outputs {
-		if utxo.Address != "" {
-			out_addrs = append(out_addrs, utxo.Address)
-		}
-	}
-	return out_addrs
-}
-
-func GetTxTime(tx Transaction) string {
+func GetTxTime(tx chain.Transaction) string {
 	timeLayout := "2006-01-02 15:04:05"
 	return time.Unix(int64(tx.Time), 0).Format(timeLayout)
 }
 
-func InsertTransaction(driver neo4j.Driver, tx Transaction) error {
+func InsertTransaction(driver neo4j.Driver, tx chain.Transaction) error {
 	session := driver.NewSession(neo4j.SessionConfig{})
 	defer session.Close()
-	in_addrs, out_addrs := GetTxInAddrs(tx), GetTxOutAddrs(tx)
+	in_addrs, out_addrs := tx.InputAddresses(), tx.OutputAddresses()
 	var createTx_cql = "MERGE (tx:Transaction {id: $txid, name: $txid}, in_degree: $in_degree, out_degree: $out_degree, time: $time, height: $height)"
 	// 1. create tx node
 	params := Params{
-		"txid": tx.Txid,
-		"in_degree": len(in_addrs),
+		"txid":       tx.Txid,
+		"in_degree":  len(in_addrs),
 		"out_degree": len(out_addrs),
-		"time": GetTxTime(tx),
-		"height": tx.Block.Height,
+		"time":       GetTxTime(tx),
+		"height":     tx.Block.Height,
 	}
 	var insertInputFn = func(tx neo4j.Transaction) (interface{}, error) {
 		records, err := tx.Run(createTx_cql, params)
@@ -186,50 +131,82 @@ func InsertTransaction(driver neo4j.Driver, tx Transaction) error {
 	return nil
 }
 
-func GetProgressBar(max int) *pb.ProgressBar {
-	bar := pb.NewOptions(max,
-		// pb.OptionSetWriter(ansi.NewAnsiStdout()),
-		pb.OptionEnableColorCodes(true),
-		pb.OptionShowBytes(true),
-		pb.OptionSetWidth(40),
-		pb.OptionShowCount(),
-		pb.OptionThrottle(65*time.Millisecond),
-		pb.OptionOnCompletion(func() {
-			fmt.Fprint(os.Stderr, "\n")
-		}),
-		pb.OptionSetTheme(pb.Theme{
-			Saucer:        "[green]=[reset]",
-			SaucerHead:    "[green]>[reset]",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}))
-	return bar
-}
-
-func main() {
+// NewCommand is `graph`, importing block files into neo4j and rolling back
+// reorged blocks.
+func NewCommand() *cli.Command {
+	var (
+		uri      string
+		user     string
+		password string
+	)
 	// Neo4j 4.0, defaults to no TLS therefore use bolt:// or neo4j://
-	dbUri := "neo4j://localhost:7687"
-	driver, err := neo4j.NewDriver(dbUri, neo4j.BasicAuth("neo4j", "test", ""))
-	if err != nil {
-		err = errors.Wrap(err, "")
-		log.Fatal(err)
-	}
-	defer driver.Close()
-	txs, err := ReadTransaction("/home/likai/code/go_program/go_learn/result/block_height=711900.json")
-	if err != nil {
-		log.Fatal(err)
-	}
-	var n = len(txs)
-	bar := GetProgressBar(n)
-	defer bar.Close()
-	for _, tx := range txs {
-		err = InsertTransaction(driver, tx)
+	var connect = func() neo4j.Driver {
+		driver, err := neo4j.NewDriver(uri, neo4j.BasicAuth(user, password, ""))
 		if err != nil {
 			err = errors.Wrap(err, "")
 			log.Fatal(err)
 		}
-		bar.Add(1)
+		return driver
+	}
+	var graphCmd = &cli.Command{
+		Use:   "graph",
+		Short: "transaction graph in neo4j",
+	}
+	graphCmd.PersistentFlags().StringVar(&uri, "uri", "neo4j://localhost:7687", "neo4j database uri")
+	graphCmd.PersistentFlags().StringVar(&user, "user", "neo4j", "neo4j user")
+	graphCmd.PersistentFlags().StringVar(&password, "password", "test", "neo4j password")
+
+	var importCmd = &cli.Command{
+		Use:   "import [block files]",
+		Short: "insert transactions of block files saved by the crawler",
+		Args:  cli.MinimumNArgs(1),
+		Run: func(cmd *cli.Command, args []string) {
+			driver := connect()
+			defer driver.Close()
+			for _, path := range args {
+				txs, err := ReadTransaction(path)
+				if err != nil {
+					log.Fatal(err)
+				}
+				var n = len(txs)
+				bar := utils.GetProgressBar(n)
+				for _, tx := range txs {
+					err = InsertTransaction(driver, tx)
+					if err != nil {
+						err = errors.Wrap(err, "")
+						log.Fatal(err)
+					}
+					bar.Add(1)
+				}
+				bar.Close()
+			}
+			fmt.Println("Done!")
+		},
+	}
+
+	var rollbackCmd = &cli.Command{
+		Use:   "rollback [reorg_events.jsonl]",
+		Short: "remove txs of blocks reorged out of mainchain",
+		Long: `remove txs of orphaned blocks recorded in reorg events written by
+	` + "`crawl sync`" + `, run it before importing the blocks downloaded again.`,
+		Args: cli.ExactArgs(1),
+		Run: func(cmd *cli.Command, args []string) {
+			driver := connect()
+			defer driver.Close()
+			events, err := ReadReorgEvents(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, event := range events {
+				if err := RollbackReorg(driver, event); err != nil {
+					log.Fatal(err)
+				}
+			}
+			fmt.Printf("%d reorg(s) rolled back\n", len(events))
+		},
 	}
-	fmt.Println("Done!")
+	// Add subcommand
+	graphCmd.AddCommand(importCmd)
+	graphCmd.AddCommand(rollbackCmd)
+	return graphCmd
 }
@@ -0,0 +1,92 @@
+package graph_db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+	"github.com/pkg/errors"
+)
+
+// ReorgEvent is written by `crawler sync` into reorg_events.jsonl when saved
+// blocks leave the mainchain, their files are moved to `reorged/<hash>/`.
+type ReorgEvent struct {
+	Time       int64 `json:"time"`
+	ForkHeight uint  `json:"fork_height"`
+	Orphaned   []struct {
+		Height uint     `json:"height"`
+		Hash   string   `json:"hash"`
+		Files  []string `json:"files"`
+	} `json:"orphaned"`
+}
+
+func ReadReorgEvents(path string) ([]ReorgEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read file: %s error", path))
+		return nil, err
+	}
+	defer f.Close()
+	var events []ReorgEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event ReorgEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			err = errors.Wrap(err, "unmarshall error")
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		err = errors.Wrap(err, "scanner error")
+		return nil, err
+	}
+	return events, nil
+}
+
+// RollbackReorg deletes txs of the orphaned blocks of event from the graph,
+// addresses left without any tx are deleted too. Run it before inserting
+// the replacement blocks, txs mined again there are inserted again.
+func RollbackReorg(driver neo4j.Driver, event ReorgEvent) error {
+	session := driver.NewSession(neo4j.SessionConfig{})
+	defer session.Close()
+	for _, block := range event.Orphaned {
+		for _, path := range block.Files {
+			txs, err := ReadTransaction(path)
+			if err != nil {
+				return err
+			}
+			txids := make([]string, 0, len(txs))
+			for _, tx := range txs {
+				txids = append(txids, tx.Txid)
+			}
+			params := Params{"txids": txids}
+			var deleteTxFn = func(tx neo4j.Transaction) (interface{}, error) {
+				records, err := tx.Run("MATCH (tx:Transaction) WHERE tx.id IN $txids DETACH DELETE tx", params)
+				if err != nil {
+					return nil, err
+				}
+				return records, nil
+			}
+			if _, err := session.WriteTransaction(deleteTxFn); err != nil {
+				err = errors.Wrap(err, fmt.Sprintf("rollback block %s at height %d failed!", block.Hash, block.Height))
+				return err
+			}
+		}
+	}
+	var deleteAddrFn = func(tx neo4j.Transaction) (interface{}, error) {
+		records, err := tx.Run("MATCH (addr:Addr) WHERE NOT (addr)--() DELETE addr", nil)
+		if err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+	if _, err := session.WriteTransaction(deleteAddrFn); err != nil {
+		err = errors.Wrap(err, "delete dangling addresses failed!")
+		return err
+	}
+	return nil
+}
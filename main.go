@@ -1,56 +1,48 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
 	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
 
-	"github.com/pkg/errors"
+	"github.com/kevin2li/go_learn/analysis"
+	"github.com/kevin2li/go_learn/config"
+	"github.com/kevin2li/go_learn/graph_db"
+	"github.com/kevin2li/go_learn/net_learn"
+	"github.com/kevin2li/go_learn/utils"
+	cli "github.com/spf13/cobra"
 )
 
-type Stu struct {
-	Name   string  `json:"name"`
-	Gender bool    `json:"gender"`
-	Score  float64 `json:"score"`
-}
-
-func Save(path string, content []byte, flag int) error {
-	// check path exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		dir := filepath.Dir(path)
-		os.MkdirAll(dir, 0766)
-	}
-	// open or create file for writing
-	file, err := os.OpenFile(path, flag, 0666)
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("Open file `%s` error", path))
-		return err
-	}
-	defer file.Close()
-	// write content
-	writer := bufio.NewWriter(file)
-	_, err = writer.Write(content)
-	writer.Flush()
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("save file `%s` error", path))
-		return err
+func main() {
+	var conf = config.New()
+	var (
+		configPath string
+		logLevel   string
+		dataDir    string
+	)
+	var rootCmd = &cli.Command{
+		Use:   "go_learn",
+		Short: "crawl bitcoin blocks, cluster addresses and import transactions into neo4j",
+		// settings not given by flags come from environment or config file
+		PersistentPreRunE: func(cmd *cli.Command, args []string) error {
+			if err := config.Load(conf, configPath); err != nil {
+				return err
+			}
+			if err := config.Bind(conf, cmd); err != nil {
+				return err
+			}
+			return utils.SetLogLevel(logLevel)
+		},
 	}
-	return nil
-}
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "config file (default ./go_learn.yaml or ~/.config/go_learn/go_learn.yaml)")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "least level of logs printed: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&dataDir, "data-dir", "", "directory of block files, used when no --savedir or dataset path given")
 
-func main() {
-	var result []string
-	result_dir := "/home/likai/code/go_program/go_learn/result"
-	for i := 712000; i < 712800; i++ {
-		path := filepath.Join(result_dir, fmt.Sprintf("block_height=%d.json", i))
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			result = append(result, strconv.Itoa(i))
-		}
+	// Add subcommand, `completion` is added by cobra
+	rootCmd.AddCommand(net_learn.NewCommand())
+	rootCmd.AddCommand(net_learn.NewAuditCommand())
+	rootCmd.AddCommand(analysis.NewCommand())
+	rootCmd.AddCommand(graph_db.NewCommand())
+	rootCmd.AddCommand(config.ShowCommand(conf))
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
 	}
-	fmt.Println("total: ", len(result))
-	content := strings.Join(result, " ")
-	Save("failed_block.txt", []byte(content), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
 }
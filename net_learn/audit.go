@@ -0,0 +1,216 @@
+package net_learn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/kevin2li/go_learn/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	auditReportFile  = "audit_report.json"
+	retryHeightsFile = "retry_heights.txt"
+)
+
+// kinds of block file problems found by audit
+const (
+	AuditMissing    = "missing"    // no block file at height
+	AuditPartial    = "partial"    // only an unfinished `.part` file
+	AuditUnreadable = "unreadable" // file can not be read or decompressed
+	AuditTruncated  = "truncated"  // json ends early
+	AuditInvalid    = "invalid"    // not a json array of txs
+	AuditEmpty      = "empty"      // no tx at all
+	AuditTxCount    = "tx_count"   // tx count differs from saved header
+	AuditNoHeader   = "no_header"  // file saved before headers were kept, a note only
+)
+
+type AuditIssue struct {
+	Height uint   `json:"height"`
+	Kind   string `json:"kind"`
+	File   string `json:"file,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// AuditReport is written as json by `crawler audit`, Retry lists heights
+// with issues to download again. Notes are findings which need no download.
+type AuditReport struct {
+	Savedir string       `json:"savedir"`
+	From    uint         `json:"from"`
+	To      uint         `json:"to"`
+	Checked int          `json:"checked"`
+	Ok      int          `json:"ok"`
+	Issues  []AuditIssue `json:"issues"`
+	Notes   []AuditIssue `json:"notes"`
+	Retry   []uint       `json:"retry"`
+}
+
+func (c *Crawler) savedPath(name string) string {
+	return filepath.Join(c.savedir, name)
+}
+
+// auditHeight checks every block file of height, a height may be saved in
+// several formats. Files without a saved header are returned as notes.
+func (c *Crawler) auditHeight(height uint) (issues []AuditIssue, notes []AuditIssue) {
+	files, err := c.blockFiles(height)
+	if err != nil {
+		return []AuditIssue{{Height: height, Kind: AuditUnreadable, Detail: err.Error()}}, nil
+	}
+	if len(files) == 0 {
+		parts, _ := filepath.Glob(filepath.Join(c.savedir, fmt.Sprintf("block_height=%d.*%s", height, partSuffix)))
+		if len(parts) > 0 {
+			return []AuditIssue{{Height: height, Kind: AuditPartial, File: parts[0]}}, nil
+		}
+		return []AuditIssue{{Height: height, Kind: AuditMissing}}, nil
+	}
+	header, hasHeader := mainHeader(c.headers.Get(height))
+	for _, path := range files {
+		count, issue := auditFile(height, path)
+		switch {
+		case issue != nil:
+			issues = append(issues, *issue)
+		case !hasHeader:
+			notes = append(notes, AuditIssue{Height: height, Kind: AuditNoHeader, File: path})
+		case header.TxCount != count:
+			issues = append(issues, AuditIssue{Height: height, Kind: AuditTxCount, File: path,
+				Detail: fmt.Sprintf("%d txs saved, header of %s says %d", count, header.Hash, header.TxCount)})
+		}
+	}
+	return issues, notes
+}
+
+// auditFile reads the block file at path and returns its number of txs,
+// or the issue found.
+func auditFile(height uint, path string) (int, *AuditIssue) {
+	content, err := fs.ReadBlock(path)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// compressed stream ends early
+		return 0, &AuditIssue{Height: height, Kind: AuditTruncated, File: path, Detail: summary(err)}
+	}
+	if err != nil {
+		return 0, &AuditIssue{Height: height, Kind: AuditUnreadable, File: path, Detail: summary(err)}
+	}
+	var txs []json.RawMessage
+	if err := json.Unmarshal(content, &txs); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) && strings.Contains(err.Error(), "unexpected end") {
+			return 0, &AuditIssue{Height: height, Kind: AuditTruncated, File: path, Detail: err.Error()}
+		}
+		return 0, &AuditIssue{Height: height, Kind: AuditInvalid, File: path, Detail: err.Error()}
+	}
+	if len(txs) == 0 {
+		return 0, &AuditIssue{Height: height, Kind: AuditEmpty, File: path}
+	}
+	return len(txs), nil
+}
+
+// Audit checks block files of heights in [from, to] with `workers`
+// goroutines.
+func (c *Crawler) Audit(from, to uint, workers int) *AuditReport {
+	if workers < 1 {
+		workers = 1
+	}
+	n := int(to - from + 1)
+	bar := utils.GetProgressBar(n)
+	defer bar.Close()
+	bar.Describe("audit block files :")
+	heights := make(chan uint)
+	type result struct{ issues, notes []AuditIssue }
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for height := range heights {
+				issues, notes := c.auditHeight(height)
+				if len(issues) > 0 || len(notes) > 0 {
+					results <- result{issues, notes}
+				}
+				bar.Add(1)
+			}
+		}()
+	}
+	go func() {
+		for height := from; height <= to; height++ {
+			heights <- height
+		}
+		close(heights)
+		wg.Wait()
+		close(results)
+	}()
+
+	report := &AuditReport{Savedir: c.savedir, From: from, To: to, Issues: make([]AuditIssue, 0),
+		Notes: make([]AuditIssue, 0), Retry: make([]uint, 0)}
+	for r := range results {
+		report.Issues = append(report.Issues, r.issues...)
+		report.Notes = append(report.Notes, r.notes...)
+	}
+	sortAuditIssues(report.Issues)
+	sortAuditIssues(report.Notes)
+	for _, issue := range report.Issues {
+		// several files of a height may have issues
+		if n := len(report.Retry); n == 0 || report.Retry[n-1] != issue.Height {
+			report.Retry = append(report.Retry, issue.Height)
+		}
+	}
+	report.Checked = n
+	report.Ok = report.Checked - len(report.Retry)
+	return report
+}
+
+func sortAuditIssues(issues []AuditIssue) {
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Height != issues[j].Height {
+			return issues[i].Height < issues[j].Height
+		}
+		return issues[i].File < issues[j].File
+	})
+}
+
+// Save writes the json report and the retry list, one line of heights
+// separated by spaces which `crawl download -f` reads.
+func (r *AuditReport) Save(reportPath, retryPath string) error {
+	obj, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		err = errors.Wrap(err, "Marshal Error")
+		return err
+	}
+	if err := fs.Save(reportPath, obj, os.O_CREATE|os.O_WRONLY|os.O_TRUNC); err != nil {
+		return err
+	}
+	heights := make([]string, 0, len(r.Retry))
+	for _, h := range r.Retry {
+		heights = append(heights, strconv.Itoa(int(h)))
+	}
+	content := strings.Join(heights, " ") + "\n"
+	return fs.Save(retryPath, []byte(content), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+}
+
+func (r *AuditReport) Print() {
+	counts := make(map[string]int)
+	for _, issue := range r.Issues {
+		counts[issue.Kind]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		log.Printf("Audit: %d %s\n", counts[kind], kind)
+	}
+	if len(r.Notes) > 0 {
+		log.Printf("Audit: %d files without saved header, not retried\n", len(r.Notes))
+	}
+	log.Printf("Audit: %d heights checked in [%d, %d], %d ok, %d to retry\n", r.Checked, r.From, r.To, r.Ok, len(r.Retry))
+}
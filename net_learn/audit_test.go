@@ -0,0 +1,80 @@
+package net_learn
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"block_height=1.json":       `[{"txid":"a"},{"txid":"b"}]`,
+		"block_height=1.jsonl":      "{\"txid\":\"a\"}\n", // a second format of height 1, one tx short
+		"block_height=2.json":       `[{"txid":"c"}]`,     // saved before headers were kept
+		"block_height=3.json":       `[{"txid":"d"},`,
+		"block_height=4.json":       `[]`,
+		"block_height=5.jsonl.part": "{\"txid\":\"e\"}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := OpenHeaderStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []Header{{Hash: "h1", Height: 1, Mainchain: true, TxCount: 2}, {Hash: "h3", Height: 3, Mainchain: true, TxCount: 1}} {
+		if err := store.Put(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	headers, err := LoadHeaderStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Crawler{savedir: dir, headers: headers}
+	report := c.Audit(1, 6, 2)
+
+	var kinds []string
+	for _, issue := range report.Issues {
+		kinds = append(kinds, fmt.Sprintf("%d %s", issue.Height, issue.Kind))
+	}
+	want := []string{"1 tx_count", "3 truncated", "4 empty", "5 partial", "6 missing"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("issues %q, want %q", kinds, want)
+	}
+	// the json file of height 1 is fine, its jsonl file is not
+	if file := filepath.Base(report.Issues[0].File); file != "block_height=1.jsonl" {
+		t.Fatalf("tx_count issue of %s, want the jsonl file", file)
+	}
+	if len(report.Notes) != 1 || report.Notes[0].Kind != AuditNoHeader || report.Notes[0].Height != 2 {
+		t.Fatalf("notes %+v, want no_header at 2", report.Notes)
+	}
+	if !reflect.DeepEqual(report.Retry, []uint{1, 3, 4, 5, 6}) || report.Ok != 1 {
+		t.Fatalf("retry %v with %d ok, want 1 3 4 5 6 with 1 ok", report.Retry, report.Ok)
+	}
+}
+
+func TestLoadHeaderStoreIsReadOnly(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	store, err := LoadHeaderStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Heights()) != 0 {
+		t.Fatalf("heights %v in an empty store", store.Heights())
+	}
+	if err := store.Put(Header{Hash: "h1", Height: 1}); err == nil {
+		t.Fatal("Put succeeded on a read-only store")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("save directory created: %v", err)
+	}
+	store.Close()
+}
@@ -0,0 +1,145 @@
+package net_learn
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/pkg/errors"
+)
+
+// states of a block height recorded in the checkpoint journal
+const (
+	StatePending  = "pending"
+	StateFetching = "fetching"
+	StateDone     = "done"
+	StateFailed   = "failed"
+)
+
+const checkpointFile = "checkpoint.jsonl"
+
+type Checkpoint struct {
+	Height int    `json:"height"`
+	State  string `json:"state"`
+	Error  string `json:"error,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+// Journal is an append-only log of block height states kept in the save
+// directory, one json object per line. The last line of a height wins.
+type Journal struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	states map[int]Checkpoint
+}
+
+func OpenJournal(savedir string) (*Journal, error) {
+	path := filepath.Join(savedir, checkpointFile)
+	if err := os.MkdirAll(savedir, 0766); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("create save directory `%s` failed", savedir))
+		return nil, err
+	}
+	j := &Journal{path: path, states: make(map[int]Checkpoint)}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("open checkpoint journal `%s` failed", path))
+		return nil, err
+	}
+	j.file = file
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read checkpoint journal `%s` failed", j.path))
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var cp Checkpoint
+		// a crash may leave the last line half written, skip it
+		if err := json.Unmarshal(scanner.Bytes(), &cp); err != nil {
+			continue
+		}
+		j.states[cp.Height] = cp
+	}
+	if err := scanner.Err(); err != nil {
+		err = errors.Wrap(err, "scanner error")
+		return err
+	}
+	return nil
+}
+
+// Mark records the state of given height, err is only kept for failed state.
+func (j *Journal) Mark(height int, state string, err error) error {
+	cp := Checkpoint{Height: height, State: state, Time: time.Now().Unix()}
+	if err != nil {
+		cp.Error = err.Error()
+	}
+	line, _ := json.Marshal(cp)
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.states[height] = cp
+	if _, err := j.file.Write(line); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("write checkpoint journal `%s` failed", j.path))
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *Journal) State(height int) (Checkpoint, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cp, ok := j.states[height]
+	return cp, ok
+}
+
+// Unfinished returns sorted heights which are not done yet.
+func (j *Journal) Unfinished() []int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	heights := make([]int, 0)
+	for h, cp := range j.states {
+		if cp.State != StateDone {
+			heights = append(heights, h)
+		}
+	}
+	sort.Ints(heights)
+	return heights
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// check whether block file exists and holds all txs of the block
+func IsBlockComplete(path string, ntx int) bool {
+	content, err := fs.ReadBlock(path)
+	if err != nil {
+		return false
+	}
+	var txs []json.RawMessage
+	if err := json.Unmarshal(content, &txs); err != nil {
+		return false
+	}
+	return len(txs) == ntx
+}
@@ -0,0 +1,183 @@
+package net_learn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client issues http requests for block sources, every request goes
+// through the rate limiter of its host, with a user agent and a proxy
+// picked by their strategies if given.
+type Client struct {
+	ua      UAStrategy    // user agent of each request, go default if nil
+	proxies *ProxyPool    // proxies of requests, direct connection if nil
+	limiter *Limiter      // request rate of each API host
+	timeout time.Duration // deadline of each request, no deadline if 0
+	http    http.Client
+}
+
+// HTTPError is returned when server answers with a non 200 status.
+type HTTPError struct {
+	Url        string
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("request for %s failed: %s, response is:\n %s", e.Url, e.Status, preview(e.Body, 200))
+}
+
+// ReadUserAgents reads a json array of browser user agents.
+func ReadUserAgents(ua_path string) ([]string, error) {
+	var ua_pool []string
+	content, err := os.ReadFile(ua_path)
+	if err != nil {
+		err = errors.Wrap(err, "read ua_path failed")
+		return nil, err
+	}
+	err = json.Unmarshal(content, &ua_pool)
+	if err != nil {
+		err = errors.Wrap(err, "unmarshall ua_pool failed")
+		return nil, err
+	}
+	return ua_pool, nil
+}
+
+// first n bytes of response body for error messages
+func preview(body []byte, n int) string {
+	if len(body) > n {
+		body = body[:n]
+	}
+	return string(body)
+}
+
+// server answers with an html error page instead of json when throttling
+func isHTMLPage(resp *http.Response, body []byte) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return true
+	}
+	trimmed := strings.TrimSpace(preview(body, 64))
+	return strings.HasPrefix(trimmed, "<")
+}
+
+func (cl *Client) Get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("request for %s error!", url))
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return cl.Do(req)
+}
+
+func (cl *Client) Post(ctx context.Context, url string, content []byte, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(content))
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("request for %s error!", url))
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return cl.Do(req)
+}
+
+// Do issues request through the rate limiter of its host, the limiter
+// slows down when the server returns 429 or an html error page. The
+// request is canceled with its context or after `cl.timeout`. The proxy
+// used is marked failed on connection errors and banned when the server
+// refuses it.
+func (cl *Client) Do(req *http.Request) ([]byte, error) {
+	url := req.URL.String()
+	if cl.ua != nil {
+		req.Header.Set("User-Agent", cl.ua.Pick())
+	}
+	httpClient := &cl.http
+	var proxy *Proxy
+	if cl.proxies != nil {
+		var err error
+		if proxy, err = cl.proxies.Get(req.Context()); err != nil {
+			return nil, err
+		}
+		httpClient = proxy.client
+	}
+
+	/* issue request and wait response*/
+	bucket := cl.limiter.Bucket(req.URL.Host)
+	if err := bucket.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	if cl.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), cl.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if proxy != nil && req.Context().Err() == nil {
+			cl.proxies.Fail(proxy, false, summary(err))
+		}
+		if proxy != nil {
+			err = errors.Wrap(err, fmt.Sprintf("request for %s through proxy %s failed!", url, proxy))
+			return nil, err
+		}
+		err = errors.Wrap(err, fmt.Sprintf("request for %s failed!", url))
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		if proxy != nil && req.Context().Err() == nil {
+			cl.proxies.Fail(proxy, false, summary(err))
+		}
+		err = errors.Wrap(err, fmt.Sprintf("read response failed, request url is: %s", url))
+		return nil, err
+	}
+
+	/* check throttling */
+	if resp.StatusCode == http.StatusTooManyRequests {
+		bucket.SlowDown(retryAfter(resp.Header.Get("Retry-After"), 10*time.Second))
+		logSlowDown(req.URL.Host, "429 Too Many Requests", bucket)
+		if proxy != nil {
+			cl.proxies.Fail(proxy, true, resp.Status)
+		}
+		return nil, &HTTPError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+	}
+	if isHTMLPage(resp, body) {
+		bucket.SlowDown(10 * time.Second)
+		logSlowDown(req.URL.Host, "html error page", bucket)
+		log.Printf("DEBUG: html error page from %s: %s\n", req.URL.Host, preview(body, 200))
+		if proxy != nil {
+			cl.proxies.Fail(proxy, true, "html error page")
+		}
+		return nil, &HTTPError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+	}
+	if proxy != nil {
+		switch {
+		// proxy refused or blocked by the server
+		case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusProxyAuthRequired:
+			cl.proxies.Fail(proxy, true, resp.Status)
+		// bad gateway and the like come from the proxy, not the server
+		case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout:
+			cl.proxies.Fail(proxy, false, resp.Status)
+		default:
+			cl.proxies.Success(proxy)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return body, &HTTPError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+	}
+	bucket.SpeedUp()
+	return body, nil
+}
@@ -0,0 +1,444 @@
+package net_learn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/pkg/errors"
+	cli "github.com/spf13/cobra"
+)
+
+// NewCommand is `crawl`, downloading blocks from a data source and
+// checking the saved ones.
+func NewCommand() *cli.Command {
+	var client = &Client{}
+	var crawler = &Crawler{
+		client: client,
+		retry:  DefaultRetryPolicy,
+	}
+
+	var (
+		isInterval bool
+		filepath   string
+		rate       float64
+		burst      int
+		hostRates  []string
+		sourceOpts SourceOptions
+		deadline   time.Duration
+		from       uint
+		maxReorg   int
+		poll       time.Duration
+		confirms   int
+		listen     string
+		hashQuery  string
+		asJSON     bool
+		withReorg  bool
+		uaPath     string
+		uaStrategy string
+		proxyPath  string
+		proxyPick  string
+		cooldown   time.Duration
+	)
+
+	// set up rate limiter, source, checkpoint journal and header store of
+	// commands crawling blocks, the returned func closes them
+	var setup = func() func() {
+		if rate <= 0 {
+			log.Fatalln("--rate should be greater than 0")
+		}
+		if crawler.page < 1 {
+			log.Fatalln("--page should be greater than 0")
+		}
+		if uaPath != "" {
+			agents, err := ReadUserAgents(uaPath)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			if client.ua, err = NewUAStrategy(uaStrategy, agents); err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+		}
+		if proxyPath != "" {
+			proxies, err := ReadProxies(proxyPath)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			strategy, err := NewProxyStrategy(proxyPick)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			client.proxies = NewProxyPool(proxies, strategy, cooldown)
+			log.Printf("INFO: %d proxies loaded from %s\n", len(proxies), proxyPath)
+		}
+		ext, err := fs.BlockExt(crawler.format, crawler.compress)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		crawler.ext = ext
+		client.limiter = NewLimiter(rate, burst)
+		host_rates, err := ParseHostRates(hostRates)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		for host, conf := range host_rates {
+			client.limiter.SetHost(host, conf)
+		}
+		crawler.source, err = NewSource(sourceOpts, client)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		journal, err := OpenJournal(crawler.savedir)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		crawler.journal = journal
+		headers, err := OpenHeaderStore(crawler.savedir)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		crawler.headers = headers
+		return func() {
+			headers.Close()
+			journal.Close()
+		}
+	}
+	// download blocks and check the downloaded range links up before
+	// anyone analyzes it
+	var download = func(ctx context.Context, blocks []chain.Block) {
+		crawler.DownloadAllBlocks(ctx, blocks)
+		if len(blocks) == 0 {
+			return
+		}
+		low, high := blocks[0].Height, blocks[0].Height
+		for _, block := range blocks {
+			if block.Height < low {
+				low = block.Height
+			}
+			if block.Height > high {
+				high = block.Height
+			}
+		}
+		reportChain(VerifyChain(crawler.headers, low, high), low, high)
+	}
+	// flags of commands crawling blocks
+	var addCrawlFlags = func(cmd *cli.Command) {
+		cmd.Flags().StringVarP(&crawler.savedir, "savedir", "s", "result", "result save directory")
+		cmd.Flags().StringVar(&crawler.format, "format", fs.FormatJSON, "block file format: json (one array) or jsonl (one tx per line)")
+		cmd.Flags().StringVar(&crawler.compress, "compress", fs.CompressNone, "block file compression: none, gzip or zstd")
+		cmd.Flags().IntVarP(&crawler.workers, "workers", "w", 4, "number of blocks downloaded concurrently")
+		cmd.Flags().IntVar(&crawler.page, "page", 10, "number of txs each request gets")
+		cmd.Flags().StringVar(&uaPath, "ua-path", "", "json file of user agents, go default user agent if empty")
+		cmd.Flags().StringVar(&uaStrategy, "ua-strategy", StrategyRandom, "how user agents are picked: random or round-robin")
+		cmd.Flags().StringVar(&proxyPath, "proxy-path", "", "file of http, https or socks5 proxies, one url per line, no proxy if empty")
+		cmd.Flags().StringVar(&proxyPick, "proxy-strategy", StrategyScore, "how proxies are picked: random, round-robin or score (weighted by health)")
+		cmd.Flags().DurationVar(&cooldown, "proxy-cooldown", 5*time.Minute, "how long a failing proxy is quarantined")
+		cmd.Flags().Float64Var(&rate, "rate", 1, "requests per second to each API host, shared by all workers, an rpc node is only limited by --host-rate")
+		cmd.Flags().IntVar(&burst, "burst", 3, "max burst of requests to each API host")
+		cmd.Flags().StringSliceVar(&hostRates, "host-rate", nil, "rate of given API host as host=rate[:burst], overrides --rate and --burst")
+		cmd.Flags().StringVar(&sourceOpts.Name, "source", "haskoin", "data source: haskoin, esplora or rpc")
+		cmd.Flags().StringVar(&sourceOpts.Url, "url", "", "base url of data source, default url of the source if empty")
+		cmd.Flags().StringVar(&sourceOpts.RPCUser, "rpc-user", "", "user of bitcoin core json-rpc")
+		cmd.Flags().StringVar(&sourceOpts.RPCPassword, "rpc-password", "", "password of bitcoin core json-rpc")
+		cmd.Flags().StringVar(&sourceOpts.RPCCookie, "rpc-cookie", "", "cookie file of bitcoin core json-rpc, used without --rpc-user (default ~/.bitcoin/.cookie)")
+		cmd.Flags().IntVar(&crawler.retry.MaxAttempts, "retries", DefaultRetryPolicy.MaxAttempts, "max attempts of each request")
+		cmd.Flags().DurationVar(&crawler.retry.BaseDelay, "retry-delay", DefaultRetryPolicy.BaseDelay, "delay before first retry, doubled each retry")
+		cmd.Flags().DurationVar(&crawler.retry.MaxDelay, "retry-max-delay", DefaultRetryPolicy.MaxDelay, "max delay between retries")
+		cmd.Flags().DurationVar(&client.timeout, "timeout", time.Minute, "deadline of each request, 0 means no deadline")
+	}
+
+	var crawlCmd = &cli.Command{
+		Use:   "crawl",
+		Short: "download blocks from a data source and check saved ones",
+	}
+
+	var downloadCmd = &cli.Command{
+		Use:   "download [heights to download]",
+		Short: "download transactions in given block heights",
+		Long: `download transactions in given block heights.
+	Please give reasonable block heights.`,
+		Args: func(cmd *cli.Command, args []string) error {
+			if isInterval && len(args) != 2 {
+				return errors.New("you should only given 2 args with `-r` flag")
+			}
+			return nil
+		},
+		Run: func(cmd *cli.Command, args []string) {
+			t1 := time.Now()
+			log.Println("Started!")
+			cleanup := setup()
+			defer cleanup()
+			parent := context.Background()
+			if deadline > 0 {
+				var cancel context.CancelFunc
+				parent, cancel = context.WithTimeout(parent, deadline)
+				defer cancel()
+			}
+			// Ctrl-C while getting blocks just stops, the pool drains itself
+			ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			var blocks []chain.Block
+			var err error
+			switch {
+			// continue unfinished heights recorded in checkpoint journal
+			case crawler.resume && !isInterval && filepath == "" && len(args) == 0:
+				heights := crawler.journal.Unfinished()
+				log.Printf("Resume: %d unfinished heights in checkpoint journal\n", len(heights))
+				blocks, err = crawler.GetBlocks(ctx, heights)
+			// download txs in given block heights range
+			case isInterval:
+				low, _ := strconv.Atoi(args[0])
+				high, _ := strconv.Atoi(args[1])
+				blocks, err = crawler.GetBlocksInRange(ctx, low, high)
+			// read heights from file
+			case filepath != "":
+				heights, _ := ReadHeights(filepath)
+				blocks, err = crawler.GetBlocks(ctx, heights)
+			// download txs in given heights
+			default:
+				heights, _ := Strings2Ints(args)
+				blocks, err = crawler.GetBlocks(ctx, heights)
+			}
+			stop()
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			download(parent, blocks)
+			t2 := time.Now()
+			log.Println("Finished!")
+			fmt.Printf("Time elapsed: %.2f minutes\n", t2.Sub(t1).Minutes())
+		},
+	}
+	addCrawlFlags(downloadCmd)
+	downloadCmd.Flags().BoolVarP(&isInterval, "interval", "r", false, "")
+	downloadCmd.Flags().StringVarP(&filepath, "filepath", "f", "", "file store heights to download")
+	downloadCmd.Flags().DurationVar(&deadline, "deadline", 0, "deadline of the whole download, 0 means no deadline")
+	downloadCmd.Flags().BoolVar(&crawler.resume, "resume", false, "skip downloaded heights, continue unfinished ones in checkpoint journal if no heights given")
+
+	var syncCmd = &cli.Command{
+		Use:   "sync",
+		Short: "download blocks up to the chain tip, rolling back reorged blocks",
+		Long: `download blocks above the highest saved height up to the chain tip.
+	Saved blocks no longer in the canonical chain are moved to reorged/<hash>/,
+	their heights are downloaded again and a reorg event is appended to
+	reorg_events.jsonl for downstream stores to roll back.`,
+		Run: func(cmd *cli.Command, args []string) {
+			t1 := time.Now()
+			log.Println("Started!")
+			cleanup := setup()
+			defer cleanup()
+			// blocks left by an interrupted sync are continued
+			crawler.resume = true
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			blocks, _, err := crawler.SyncBlocks(ctx, from, maxReorg)
+			stop()
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			download(context.Background(), blocks)
+			t2 := time.Now()
+			log.Println("Finished!")
+			fmt.Printf("Time elapsed: %.2f minutes\n", t2.Sub(t1).Minutes())
+		},
+	}
+	addCrawlFlags(syncCmd)
+	syncCmd.Flags().UintVar(&from, "from", 0, "first height to download if nothing saved yet")
+	syncCmd.Flags().IntVar(&maxReorg, "max-reorg", 100, "give up if no common block found within this many heights")
+
+	var followCmd = &cli.Command{
+		Use:   "follow",
+		Short: "keep downloading new blocks as the chain tip grows",
+		Long: `poll the source for the chain tip and download new blocks as they appear,
+	rolling back reorged blocks like sync. Blocks with enough confirmations
+	which link up are finalized, the finalized height is kept in
+	finalized_height of the save directory. Status is served as json on
+	http://<listen>/status.`,
+		Run: func(cmd *cli.Command, args []string) {
+			cleanup := setup()
+			defer cleanup()
+			crawler.resume = true
+			follower := NewFollower(crawler, poll, confirms, maxReorg, from)
+			mux := http.NewServeMux()
+			mux.Handle("/status", follower)
+			server := &http.Server{Addr: listen, Handler: mux}
+			go func() {
+				if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Fatalf("%+v\n", err)
+				}
+			}()
+			log.Printf("Follow: status served on http://%s/status\n", listen)
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			follower.Run(ctx)
+			server.Close()
+			log.Println("Finished!")
+		},
+	}
+	addCrawlFlags(followCmd)
+	followCmd.Flags().UintVar(&from, "from", 0, "first height to download if nothing saved yet, the chain tip if 0")
+	followCmd.Flags().IntVar(&maxReorg, "max-reorg", 100, "give up if no common block found within this many heights")
+	followCmd.Flags().DurationVar(&poll, "poll", time.Minute, "how often to ask the source for the chain tip")
+	followCmd.Flags().IntVar(&confirms, "confirmations", 6, "confirmations a block needs to be finalized")
+	followCmd.Flags().StringVar(&listen, "listen", "127.0.0.1:8090", "address of the status endpoint")
+
+	var headersCmd = &cli.Command{
+		Use:   "headers [low [high]]",
+		Short: "list saved headers of downloaded blocks",
+		Long: `list saved headers of downloaded blocks with heights in [low, high], or
+	the block at low if high is not given, or all saved blocks if no height
+	given. Use --hash to look up a block by its hash.`,
+		Args: cli.MaximumNArgs(2),
+		Run: func(cmd *cli.Command, args []string) {
+			store, err := LoadHeaderStore(crawler.savedir)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			if len(store.Heights()) == 0 {
+				log.Fatalf("no header saved in %s\n", crawler.savedir)
+			}
+			var headers []Header
+			switch {
+			case hashQuery != "":
+				h, ok := store.GetByHash(hashQuery)
+				if !ok {
+					log.Printf("block %s not found in %s\n", hashQuery, crawler.savedir)
+					return
+				}
+				headers = append(headers, h)
+			case len(args) > 0:
+				heights, err := Strings2Ints(args)
+				if err != nil || heights[0] < 0 {
+					log.Fatalf("invalid heights %v\n", args)
+				}
+				low, high := uint(heights[0]), uint(heights[0])
+				if len(heights) == 2 {
+					high = uint(heights[1])
+				}
+				headers = store.Range(low, high, withReorg)
+			default:
+				headers = store.Range(0, ^uint(0), withReorg)
+			}
+			if asJSON {
+				for _, h := range headers {
+					line, _ := json.Marshal(h)
+					fmt.Println(string(line))
+				}
+				return
+			}
+			PrintHeaders(os.Stdout, headers)
+		},
+	}
+	headersCmd.Flags().StringVarP(&crawler.savedir, "savedir", "s", "result", "result save directory")
+	headersCmd.Flags().StringVar(&hashQuery, "hash", "", "look up the block with this hash")
+	headersCmd.Flags().BoolVar(&asJSON, "json", false, "print one json object per header instead of a table")
+	headersCmd.Flags().BoolVar(&withReorg, "all", false, "also list blocks rolled back by sync")
+
+	var verifyCmd = &cli.Command{
+		Use:   "verify [low high]",
+		Short: "verify downloaded blocks link up in mainchain",
+		Long: `verify saved headers of blocks in [low, high]: every height has a block,
+	blocks are in mainchain and each block's previous hash is the hash of the
+	block below. All saved heights are verified if no range given.`,
+		Args: func(cmd *cli.Command, args []string) error {
+			if len(args) != 0 && len(args) != 2 {
+				return errors.New("you should give 2 args as low and high height, or none")
+			}
+			return nil
+		},
+		Run: func(cmd *cli.Command, args []string) {
+			headers, err := LoadHeaderStore(crawler.savedir)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			saved := headers.Heights()
+			if len(saved) == 0 {
+				log.Fatalf("no header saved in %s\n", crawler.savedir)
+			}
+			low, high := saved[0], saved[len(saved)-1]
+			if len(args) == 2 {
+				heights, err := Strings2Ints(args)
+				if err != nil || heights[0] < 0 || heights[0] > heights[1] {
+					log.Fatalf("invalid range %v\n", args)
+				}
+				low, high = uint(heights[0]), uint(heights[1])
+			}
+			if !reportChain(VerifyChain(headers, low, high), low, high) {
+				os.Exit(1)
+			}
+		},
+	}
+	verifyCmd.Flags().StringVarP(&crawler.savedir, "savedir", "s", "result", "result save directory")
+
+	// Add subcommand
+	crawlCmd.AddCommand(downloadCmd)
+	crawlCmd.AddCommand(syncCmd)
+	crawlCmd.AddCommand(followCmd)
+	crawlCmd.AddCommand(verifyCmd)
+	crawlCmd.AddCommand(headersCmd)
+	return crawlCmd
+}
+
+// NewAuditCommand is `audit`, checking saved block files without any
+// request to the data source.
+func NewAuditCommand() *cli.Command {
+	var crawler = &Crawler{}
+	var (
+		auditFrom  uint
+		auditTo    uint
+		jobs       int
+		reportPath string
+		retryPath  string
+	)
+	var auditCmd = &cli.Command{
+		Use:   "audit",
+		Short: "check block files in a height range and list heights to download again",
+		Long: `check block files of heights in [from, to]: missing files, unfinished
+	downloads, unreadable or truncated json, empty tx arrays and tx counts which
+	disagree with saved headers. Every file of a height is checked when it is
+	saved in several formats. Files without a saved header are noted but not
+	retried. A json report is written, and a retry list which can be given
+	to ` + "`crawl download -f`" + `.`,
+		Run: func(cmd *cli.Command, args []string) {
+			if auditTo < auditFrom {
+				log.Fatalln("--to should not be less than --from")
+			}
+			headers, err := LoadHeaderStore(crawler.savedir)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			crawler.headers = headers
+			report := crawler.Audit(auditFrom, auditTo, jobs)
+			if reportPath == "" {
+				reportPath = crawler.savedPath(auditReportFile)
+			}
+			if retryPath == "" {
+				retryPath = crawler.savedPath(retryHeightsFile)
+			}
+			if err := report.Save(reportPath, retryPath); err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			report.Print()
+			log.Printf("Save audit report at: %s, retry list at: %s\n", reportPath, retryPath)
+		},
+	}
+	auditCmd.Flags().StringVarP(&crawler.savedir, "savedir", "s", "result", "result save directory")
+	auditCmd.Flags().UintVar(&auditFrom, "from", 0, "first height to audit")
+	auditCmd.Flags().UintVar(&auditTo, "to", 0, "last height to audit, included")
+	auditCmd.Flags().IntVarP(&jobs, "jobs", "j", runtime.NumCPU(), "number of files checked in parallel")
+	auditCmd.Flags().StringVar(&reportPath, "report", "", "json report path (default <savedir>/audit_report.json)")
+	auditCmd.Flags().StringVar(&retryPath, "retry-file", "", "retry list path for crawl download -f (default <savedir>/retry_heights.txt)")
+	auditCmd.MarkFlagRequired("from")
+	auditCmd.MarkFlagRequired("to")
+	return auditCmd
+}
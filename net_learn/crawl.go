@@ -1,183 +1,53 @@
-package main
+package net_learn
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"math/rand"
-	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/kevin2li/go_learn/utils"
 	"github.com/pkg/errors"
-	pb "github.com/schollz/progressbar/v3"
-	cli "github.com/spf13/cobra"
 )
 
-type Block struct {
-	Hash      string   `json:"hash"`
-	Height    uint     `json:"height"`
-	Mainchain bool     `json:"mainchain"`
-	Previous  string   `json:"previous"`
-	Time      uint     `json:"time"`
-	Version   uint     `json:"version"`
-	Bits      uint     `json:"bits"`
-	Nonce     uint64   `json:"nonce"`
-	Size      uint     `json:"size"`
-	Tx        []string `json:"tx"`
-	Merkle    string   `json:"merkle"`
-	Subsidy   uint     `json:"subsidy"`
-	Fees      uint     `json:"fees"`
-	Outputs   uint64   `json:"outputs"`
-	// Work      uint64   `json:"work"`
-	Weight uint `json:"weight"`
-}
-
-type Transaction struct {
-	Txid     string `json:"txid"`
-	Size     uint   `json:"size"`
-	Version  uint   `json:"version"`
-	Locktime uint   `json:"locktime"`
-	Fee      uint   `json:"fee"`
-	Inputs   []struct {
-		Coinbase  bool     `json:"coinbase"`
-		Txid      string   `json:"txid"`
-		Output    uint     `json:"output"`
-		Sigscript string   `json:"sigscript"`
-		Sequence  uint64   `json:"sequence"`
-		Pkscript  string   `json:"pkscript"`
-		Value     uint     `json:"value"`
-		Address   string   `json:"address"`
-		Witness   []string `json:"witness"`
-	} `json:"inputs"`
-	Outputs []struct {
-		Address  string `json:"address"`
-		Pkscript string `json:"pkscript"`
-		Value    uint   `json:"value"`
-		Spent    bool   `json:"spent"`
-		Spender  struct {
-			Txid  string `json:"txid"`
-			Input uint   `json:"input"`
-		} `json:"spender,omitempty"`
-		Input uint `json:"input,omitempty"`
-	} `json:"outputs"`
-	Block struct {
-		Height   uint `json:"height"`
-		Position uint `json:"position"`
-	} `json:"block"`
-	Deleted bool `json:"deleted"`
-	Time    uint `json:"time"`
-	Rbf     bool `json:"rbf"`
-	Weight  uint `json:"weight"`
-}
-
 type Crawler struct {
-	getBlockUrl string   // https://api.blockchain.info/haskoin-store/btc/block/heights?heights=%s&notx=false
-	getTxUrl    string   // https://api.blockchain.info/haskoin-store/btc/transactions?txids=%s
-	savedir     string   // result save directory
-	page        int      // number of tx each request get
-	ua_pool     []string // browser user agent pool
-}
-
-func (c *Crawler) getUaPool(ua_path string) error {
-	var ua_pool []string
-	content, err := os.ReadFile(ua_path)
-	if err != nil {
-		err = errors.Wrap(err, "read ua_path failed")
-		return err
-	}
-	err = json.Unmarshal(content, &ua_pool)
-	if err != nil {
-		err = errors.Wrap(err, "unmarshall ua_pool failed")
-		return err
-	}
-	c.ua_pool = ua_pool
-	return nil
-}
-
-func (c *Crawler) GetBlocksByHeights(heights string) ([]Block, error) {
-	/* construct request */
-	url := fmt.Sprintf(c.getBlockUrl, heights)
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("User-Agent", c.ua_pool[rand.Intn(len(c.ua_pool))])
-	req.Header.Set("Content-Type", "application/json")
-
-	/* issue request and wait response*/
-	resp, err := (&http.Client{}).Do(req)
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("request for %s failed!", url))
-		return nil, err
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		err = errors.Wrap(err, "read response failed")
-		return nil, err
-	}
-
-	/* save response */
-	var blocks []Block
-	err = json.Unmarshal(body, &blocks)
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("unmarshall error, response is:\n %s", string(body)[:200]))
-		return nil, err
-	}
-	return blocks, nil
-}
-
-func (c *Crawler) GetTxsByHashs(txHashs string) ([]Transaction, error) {
-	/* construct request */
-	url := fmt.Sprintf(c.getTxUrl, txHashs)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("request for %s error!", url))
-		return nil, err
-	}
-	req.Header.Set("User-Agent", c.ua_pool[rand.Intn(len(c.ua_pool))])
-	req.Header.Set("Content-Type", "application/json")
-
-	/* issue request and wait response*/
-	resp, err := (&http.Client{}).Do(req)
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("request for %s failed!", url))
-		return nil, err
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("read response failed, request url is: %s", url))
-		return nil, err
-	}
-
-	/* save response */
-	var txs []Transaction
-	err = json.Unmarshal(body, &txs)
-	if err != nil {
-		err = errors.Wrap(err, "unmarshall failed\n")
-		Save("error_page.html", body, os.O_CREATE|os.O_WRONLY)
-		return nil, err
-	}
-	return txs, nil
+	source   BlockSource  // where blocks and transactions come from
+	client   *Client      // http client shared by sources
+	savedir  string       // result save directory
+	page     int          // number of tx each request get
+	journal  *Journal     // checkpoint journal in savedir
+	headers  *HeaderStore // headers of downloaded blocks in savedir
+	resume   bool         // skip heights already downloaded
+	workers  int          // number of blocks downloaded concurrently
+	retry    RetryPolicy  // retry of failed requests
+	format   string       // block file format: json or jsonl
+	compress string       // block file compression: none, gzip or zstd
+	ext      string       // block file extension of format and compress
 }
 
-func (c *Crawler) GetBlocks(heights []int) ([]Block, error) {
-	fmt.Printf("INFO: get txids in blocks with heights = %v...\n", heights)
-	var all_blocks []Block
+func (c *Crawler) GetBlocks(ctx context.Context, heights []int) ([]chain.Block, error) {
+	log.Printf("INFO: get txids in blocks with heights = %v...\n", heights)
+	var all_blocks []chain.Block
 	var n = len(heights)
-	bar := GetProgressBar(n)
+	bar := utils.GetProgressBar(n)
 	defer bar.Close()
 
 	for _, h := range heights {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		bar.Describe(fmt.Sprintf("download txids in block %d :", h))
-		blocks, err := c.GetBlocksByHeights(strconv.Itoa(h))
+		var blocks []chain.Block
+		_, err := c.retry.Do(ctx, fmt.Sprintf("get block %d", h), func() error {
+			var err error
+			blocks, err = c.source.GetBlocksByHeights(ctx, []int{h})
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -187,16 +57,24 @@ func (c *Crawler) GetBlocks(heights []int) ([]Block, error) {
 	return all_blocks, nil
 }
 
-func (c *Crawler) GetBlocksInRange(low, high int) ([]Block, error) {
-	fmt.Printf("INFO: get txids in blocks with heights in range [%d, %d)...\n", low, high)
-	var all_blocks []Block
+func (c *Crawler) GetBlocksInRange(ctx context.Context, low, high int) ([]chain.Block, error) {
+	log.Printf("INFO: get txids in blocks with heights in range [%d, %d)...\n", low, high)
+	var all_blocks []chain.Block
 	var n = high - low
-	bar := GetProgressBar(n)
+	bar := utils.GetProgressBar(n)
 	defer bar.Close()
 
 	for i := low; i < high; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		bar.Describe(fmt.Sprintf("downloading txids in block %d :", i))
-		blocks, err := c.GetBlocksByHeights(strconv.Itoa(i))
+		var blocks []chain.Block
+		_, err := c.retry.Do(ctx, fmt.Sprintf("get block %d", i), func() error {
+			var err error
+			blocks, err = c.source.GetBlocksByHeights(ctx, []int{i})
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -206,101 +84,169 @@ func (c *Crawler) GetBlocksInRange(low, high int) ([]Block, error) {
 	return all_blocks, nil
 }
 
-func (c *Crawler) DownloadOneBlock(block *Block, done chan int) {
+func (c *Crawler) blockPath(height uint) string {
+	return filepath.Join(c.savedir, fmt.Sprintf("block_height=%d%s", height, c.ext))
+}
+
+// DownloadOneBlock downloads all txs of block and saves them to savedir,
+// progress is called with the number of txs fetched by each request. Each
+// page is appended to a part file as soon as it arrives, with `--resume`
+// pages already in the part file are not downloaded again.
+// Failed pages are retried once more after the rest of the block, if some
+// still fail a *BlockError listing them is returned. When ctx is canceled
+// the block goes back to pending in the journal and ctx.Err() is returned.
+func (c *Crawler) DownloadOneBlock(ctx context.Context, block *chain.Block, progress func(n int)) (err error) {
 	defer func() {
-		if err := recover(); err != nil {
-			fmt.Printf("%+v\n", err)
-			done <- int(block.Height)
-		} else {
-			done <- 0
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+			c.journal.Mark(int(block.Height), StatePending, nil)
+		} else if err != nil {
+			c.journal.Mark(int(block.Height), StateFailed, err)
 		}
 	}()
-	fmt.Printf("INFO: Downloading block at height %d...\n", block.Height)
-	p, n, tx_hashs := 0, len(block.Tx), ""
-	bar := GetProgressBar(n)
-	defer bar.Close()
-	bar.Describe(fmt.Sprintf("download block %d:", block.Height))
-	var all_txs []Transaction
-	for i, tx_hash := range block.Tx {
-		tx_hashs = fmt.Sprintf("%s,%s", tx_hashs, tx_hash)
-		p++
-		// every `page` hash issue a request
-		if (p+1)%c.page == 0 || i == n-1 {
-			retry_times := 0
-		request:
-			txs, err := c.GetTxsByHashs(tx_hashs[1:])
-			if err != nil {
-				if retry_times < 5 {
-					retry_times++
-					time.Sleep(time.Duration(retry_times*10) * time.Second)
-					fmt.Printf("Retry download block %d for %d time(s)...\n", block.Height, retry_times)
-					goto request
+	c.journal.Mark(int(block.Height), StateFetching, nil)
+	n := len(block.Tx)
+	position := make(map[string]uint, n)
+	for i, txid := range block.Tx {
+		position[txid] = uint(i)
+	}
+	fetch := c.source.GetTxsByHashs
+	if bs, ok := c.source.(BlockTxsSource); ok {
+		// fetch the whole block once, then hand it out page by page
+		var block_txs map[string]chain.Transaction
+		fetch = func(ctx context.Context, txids []string) ([]chain.Transaction, error) {
+			if block_txs == nil {
+				txs, err := bs.GetBlockTxs(ctx, block)
+				if err != nil {
+					return nil, err
+				}
+				block_txs = make(map[string]chain.Transaction, len(txs))
+				for _, tx := range txs {
+					block_txs[tx.Txid] = tx
 				}
-				panic(err)
 			}
-			all_txs = append(all_txs, txs...)
-			bar.Add(p)
-			p, tx_hashs = 0, ""
+			txs := make([]chain.Transaction, 0, len(txids))
+			for _, txid := range txids {
+				tx, ok := block_txs[txid]
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("tx %s not found in block %d", txid, block.Height))
+				}
+				txs = append(txs, tx)
+			}
+			return txs, nil
 		}
 	}
-	obj, err := json.Marshal(all_txs)
-	if err != nil {
-		err = errors.Wrap(err, "Marshal Error")
-		panic(err)
+	fetchPage := func(tx_hashs []string) ([]chain.Transaction, *PageError) {
+		var txs []chain.Transaction
+		name := fmt.Sprintf("block %d page at tx %d", block.Height, position[tx_hashs[0]])
+		attempts, err := c.retry.Do(ctx, name, func() error {
+			var err error
+			txs, err = fetch(ctx, tx_hashs)
+			if err == nil && len(txs) != len(tx_hashs) {
+				err = errors.New(fmt.Sprintf("got %d txs, want %d", len(txs), len(tx_hashs)))
+			}
+			return err
+		})
+		if err != nil {
+			return nil, &PageError{Height: block.Height, Txids: tx_hashs, Attempts: attempts, Err: err}
+		}
+		// not every source knows where a tx sits in its block
+		for i := range txs {
+			txs[i].Block.Height = block.Height
+			txs[i].Block.Position = position[txs[i].Txid]
+		}
+		progress(len(tx_hashs))
+		return txs, nil
 	}
-	savepath := filepath.Join(c.savedir, fmt.Sprintf("block_height=%d.json", block.Height))
-	Save(savepath, obj, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
-	fmt.Printf("INFO: Block %d download success!\n", block.Height)
-}
 
-func (c *Crawler) DownloadAllBlocks(blocks []Block) {
-	n := len(blocks)
-	failedBlocks := make([]int, 0)
-	done := make(chan int, n)
-
-	for i := 0; i < n; i++ {
-		go c.DownloadOneBlock(&blocks[i], done)
-		// decrease access frequency
-		r := 60 + rand.Intn(5)
-		time.Sleep(time.Duration(r) * time.Second)
+	path := c.blockPath(block.Height)
+	writer, err := OpenBlockWriter(path, c.format, c.compress, c.resume)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if writer.Count() > 0 {
+		log.Printf("INFO: resume block %d with %d txs downloaded before\n", block.Height, writer.Count())
 	}
-	for i := 0; i < n; i++ {
-		if h := <-done; h != 0 {
-			failedBlocks = append(failedBlocks, h)
+	// txids of the page which are not in part file yet
+	missing := func(start int) []string {
+		end := start + c.page
+		if end > n {
+			end = n
 		}
+		var tx_hashs []string
+		for _, txid := range block.Tx[start:end] {
+			if !writer.Has(txid) {
+				tx_hashs = append(tx_hashs, txid)
+			}
+		}
+		progress(end - start - len(tx_hashs))
+		return tx_hashs
 	}
 
-	close(done)
-	log.Printf("Total : %d, Success: %d, Failure: %d\n", n, n-len(failedBlocks), len(failedBlocks))
-	if len(failedBlocks) > 0 {
-		sort.Ints(failedBlocks)
-		log.Printf("Failed blocks are: %v\n", failedBlocks)
-		content := fmt.Sprintf("%v\n", failedBlocks)
-		content = content[1:len(content)-2] + "\n"
-		Save("failed_block_heights.txt", []byte(content), os.O_CREATE|os.O_WRONLY|os.O_APPEND)
-		log.Printf("Save failed block heights at: %s", "failed_block_heights.txt")
+	failed := make(map[int]*PageError)
+	// every `page` hash issue a request
+	for start := 0; start < n; start += c.page {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tx_hashs := missing(start)
+		if len(tx_hashs) == 0 {
+			continue
+		}
+		txs, pageErr := fetchPage(tx_hashs)
+		if pageErr != nil {
+			log.Printf("WARN: %v\n", summary(pageErr))
+			failed[start] = pageErr
+			continue
+		}
+		if err := writer.WritePage(txs); err != nil {
+			return err
+		}
 	}
-}
-
-func GetProgressBar(max int) *pb.ProgressBar {
-	bar := pb.NewOptions(max,
-		// pb.OptionSetWriter(ansi.NewAnsiStdout()),
-		pb.OptionEnableColorCodes(true),
-		pb.OptionShowBytes(true),
-		pb.OptionSetWidth(40),
-		pb.OptionShowCount(),
-		pb.OptionThrottle(65*time.Millisecond),
-		pb.OptionOnCompletion(func() {
-			fmt.Fprint(os.Stderr, "\n")
-		}),
-		pb.OptionSetTheme(pb.Theme{
-			Saucer:        "[green]=[reset]",
-			SaucerHead:    "[green]>[reset]",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}))
-	return bar
+	// retry failed pages once more instead of the whole block
+	blockErr := &BlockError{Height: block.Height}
+	for start := 0; start < n; start += c.page {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pageErr, ok := failed[start]
+		if !ok {
+			continue
+		}
+		if !IsRetryable(pageErr) {
+			blockErr.Pages = append(blockErr.Pages, pageErr)
+			continue
+		}
+		txs, pageErr := fetchPage(pageErr.Txids)
+		if pageErr != nil {
+			blockErr.Pages = append(blockErr.Pages, pageErr)
+			continue
+		}
+		if err := writer.WritePage(txs); err != nil {
+			return err
+		}
+	}
+	if len(blockErr.Pages) > 0 {
+		return blockErr
+	}
+	if err := writer.Commit(block.Tx); err != nil {
+		return err
+	}
+	// never keep a block which does not match its header
+	err = checkMerkle(block)
+	if err == nil {
+		err = checkBlockFile(path, block)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := c.headers.Put(BlockHeader(block)); err != nil {
+		return err
+	}
+	c.journal.Mark(int(block.Height), StateDone, nil)
+	return nil
 }
 
 func Strings2Ints(strs []string) ([]int, error) {
@@ -336,95 +282,3 @@ func ReadHeights(path string) ([]int, error) {
 	}
 	return heights, nil
 }
-
-func Save(path string, content []byte, flag int) error {
-	// check path exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		dir := filepath.Dir(path)
-		os.MkdirAll(dir, 0766)
-	}
-	// open or create file for writing
-	file, err := os.OpenFile(path, flag, 0666)
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("Open file `%s` error", path))
-		return err
-	}
-	defer file.Close()
-	// write content
-	writer := bufio.NewWriter(file)
-	_, err = writer.Write(content)
-	writer.Flush()
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("save file `%s` error", path))
-		return err
-	}
-	return nil
-}
-
-func main() {
-	var crawler = &Crawler{
-		getBlockUrl: "https://api.blockchain.info/haskoin-store/btc/block/heights?heights=%s&notx=false",
-		getTxUrl:    "https://api.blockchain.info/haskoin-store/btc/transactions?txids=%s",
-		page:        10,
-	}
-	crawler.getUaPool("/home/likai/code/go_program/go_learn/net_learn/ua.json")
-
-	var (
-		isInterval bool
-		filepath   string
-	)
-
-	var rootCmd = &cli.Command{Use: "crawler"}
-
-	var downloadCmd = &cli.Command{
-		Use:   "download [heights to download]",
-		Short: "download transactions in given block heights",
-		Long: `download transactions in given block heights.
-	Please give reasonable block heights.`,
-		Args: func(cmd *cli.Command, args []string) error {
-			if isInterval && len(args) != 2 {
-				return errors.New("you should only given 2 args with `-r` flag")
-			}
-			return nil
-		},
-		Run: func(cmd *cli.Command, args []string) {
-			t1 := time.Now()
-			log.Println("Started!")
-			// download txs in given block heights range
-			if isInterval {
-				low, _ := strconv.Atoi(args[0])
-				high, _ := strconv.Atoi(args[1])
-				blocks, err := crawler.GetBlocksInRange(low, high)
-				if err != nil {
-					log.Fatalf("%+v\n", err)
-				}
-				crawler.DownloadAllBlocks(blocks)
-			// read heights from file
-			} else if filepath != "" {
-				heights, _ := ReadHeights(filepath)
-				blocks, err := crawler.GetBlocks(heights)
-				if err != nil {
-					log.Fatalf("%+v\n", err)
-				}
-				crawler.DownloadAllBlocks(blocks)
-			// download txs in given heights
-			} else {
-				heights, _ := Strings2Ints(args)
-				blocks, err := crawler.GetBlocks(heights)
-				if err != nil {
-					log.Fatalf("%+v\n", err)
-				}
-				crawler.DownloadAllBlocks(blocks)
-			}
-			t2 := time.Now()
-			log.Println("Finished!")
-			fmt.Printf("Time elapsed: %.2f minutes\n", t2.Sub(t1).Minutes())
-		},
-	}
-	downloadCmd.Flags().BoolVarP(&isInterval, "interval", "r", false, "")
-	downloadCmd.Flags().StringVarP(&filepath, "filepath", "f", "", "file store heights to download")
-	downloadCmd.Flags().StringVarP(&crawler.savedir, "savedir", "s", "result", "result save directory")
-	// Add subcommand
-	rootCmd.AddCommand(downloadCmd)
-	rootCmd.Execute()
-}
@@ -0,0 +1,213 @@
+package net_learn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/pkg/errors"
+)
+
+// EsploraSource reads blocks from an Esplora REST API such as
+// https://blockstream.info/api or a self hosted electrs. Esplora gives no
+// fees of a block, they are what the coinbase claims beyond the subsidy.
+// Outputs of blocks, the total value of their outputs, is not given and
+// left 0.
+type EsploraSource struct {
+	base   string
+	client *Client
+}
+
+type esploraBlock struct {
+	Id                string `json:"id"`
+	Height            uint   `json:"height"`
+	Version           uint   `json:"version"`
+	Timestamp         uint   `json:"timestamp"`
+	TxCount           uint   `json:"tx_count"`
+	Size              uint   `json:"size"`
+	Weight            uint   `json:"weight"`
+	MerkleRoot        string `json:"merkle_root"`
+	Previousblockhash string `json:"previousblockhash"`
+	Nonce             uint64 `json:"nonce"`
+	Bits              uint   `json:"bits"`
+}
+
+type esploraOutput struct {
+	Scriptpubkey        string       `json:"scriptpubkey"`
+	ScriptpubkeyAddress string       `json:"scriptpubkey_address"`
+	Value               chain.Amount `json:"value"`
+}
+
+type esploraTx struct {
+	Txid     string `json:"txid"`
+	Version  uint   `json:"version"`
+	Locktime uint   `json:"locktime"`
+	Vin      []struct {
+		Txid       string         `json:"txid"`
+		Vout       uint           `json:"vout"`
+		Prevout    *esploraOutput `json:"prevout"`
+		Scriptsig  string         `json:"scriptsig"`
+		Witness    []string       `json:"witness"`
+		IsCoinbase bool           `json:"is_coinbase"`
+		Sequence   uint64         `json:"sequence"`
+	} `json:"vin"`
+	Vout   []esploraOutput `json:"vout"`
+	Size   uint            `json:"size"`
+	Weight uint            `json:"weight"`
+	Fee    chain.Amount    `json:"fee"`
+	Status struct {
+		Confirmed   bool   `json:"confirmed"`
+		BlockHeight uint   `json:"block_height"`
+		BlockHash   string `json:"block_hash"`
+		BlockTime   uint   `json:"block_time"`
+	} `json:"status"`
+}
+
+func NewEsploraSource(base string, client *Client) *EsploraSource {
+	return &EsploraSource{base: strings.TrimRight(base, "/"), client: client}
+}
+
+func (s *EsploraSource) getJSON(ctx context.Context, path string, v interface{}) error {
+	body, err := s.client.Get(ctx, s.base+path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("unmarshall error, response is:\n %s", preview(body, 200)))
+		return err
+	}
+	return nil
+}
+
+func (s *EsploraSource) getText(ctx context.Context, path string) (string, error) {
+	body, err := s.client.Get(ctx, s.base+path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (s *EsploraSource) GetBlocksByHeights(ctx context.Context, heights []int) ([]chain.Block, error) {
+	var blocks []chain.Block
+	for _, h := range heights {
+		hash, err := s.getText(ctx, fmt.Sprintf("/block-height/%d", h))
+		if err != nil {
+			return nil, err
+		}
+		var b esploraBlock
+		if err := s.getJSON(ctx, "/block/"+hash, &b); err != nil {
+			return nil, err
+		}
+		var txids []string
+		if err := s.getJSON(ctx, "/block/"+hash+"/txids", &txids); err != nil {
+			return nil, err
+		}
+		fees, err := s.blockFees(ctx, b.Height, txids)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, chain.Block{
+			Hash: b.Id,
+			// block-height always resolves to the best chain
+			Mainchain: true,
+			Height:    b.Height,
+			Previous:  b.Previousblockhash,
+			Time:      b.Timestamp,
+			Version:   b.Version,
+			Bits:      b.Bits,
+			Nonce:     b.Nonce,
+			Size:      b.Size,
+			Tx:        txids,
+			Merkle:    b.MerkleRoot,
+			Subsidy:   blockSubsidy(b.Height),
+			Fees:      fees,
+			Weight:    b.Weight,
+		})
+	}
+	return blocks, nil
+}
+
+// blockFees is what the coinbase, the first tx, claims beyond the subsidy.
+func (s *EsploraSource) blockFees(ctx context.Context, height uint, txids []string) (chain.Amount, error) {
+	if len(txids) == 0 {
+		return 0, nil
+	}
+	var coinbase esploraTx
+	if err := s.getJSON(ctx, "/tx/"+txids[0], &coinbase); err != nil {
+		return 0, err
+	}
+	tx := coinbase.normalize()
+	return coinbaseFees(height, &tx)
+}
+
+func (s *EsploraSource) GetTxsByHashs(ctx context.Context, txids []string) ([]chain.Transaction, error) {
+	var txs []chain.Transaction
+	for _, txid := range txids {
+		var etx esploraTx
+		if err := s.getJSON(ctx, "/tx/"+txid, &etx); err != nil {
+			return nil, err
+		}
+		txs = append(txs, etx.normalize())
+	}
+	return txs, nil
+}
+
+func (s *EsploraSource) GetTipHeight(ctx context.Context) (int, error) {
+	text, err := s.getText(ctx, "/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+	height, err := strconv.Atoi(text)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("parse tip height `%s` failed", preview([]byte(text), 200)))
+		return 0, err
+	}
+	return height, nil
+}
+
+func (etx *esploraTx) normalize() chain.Transaction {
+	tx := chain.Transaction{
+		Txid:     etx.Txid,
+		Size:     etx.Size,
+		Version:  etx.Version,
+		Locktime: etx.Locktime,
+		Fee:      etx.Fee,
+		Time:     etx.Status.BlockTime,
+		Weight:   etx.Weight,
+	}
+	tx.Block.Height = etx.Status.BlockHeight
+	for _, vin := range etx.Vin {
+		input := chain.TxInput{
+			Coinbase:  vin.IsCoinbase,
+			Sigscript: vin.Scriptsig,
+			Sequence:  vin.Sequence,
+			Witness:   vin.Witness,
+		}
+		if !vin.IsCoinbase {
+			input.Txid = vin.Txid
+			input.Output = vin.Vout
+		}
+		if vin.Prevout != nil {
+			input.Pkscript = vin.Prevout.Scriptpubkey
+			input.Value = vin.Prevout.Value
+			input.Address = vin.Prevout.ScriptpubkeyAddress
+		}
+		// replaceable if any input opts in bip125
+		if vin.Sequence < 0xfffffffe {
+			tx.Rbf = true
+		}
+		tx.Inputs = append(tx.Inputs, input)
+	}
+	for _, vout := range etx.Vout {
+		tx.Outputs = append(tx.Outputs, chain.TxOutput{
+			Address:  vout.ScriptpubkeyAddress,
+			Pkscript: vout.Scriptpubkey,
+			Value:    vout.Value,
+		})
+	}
+	return tx
+}
@@ -0,0 +1,205 @@
+package net_learn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/pkg/errors"
+)
+
+// heights up to this one have enough confirmations, verified and final
+const finalizedFile = "finalized_height"
+
+// FollowStatus is served as json by the status endpoint of `crawler follow`.
+type FollowStatus struct {
+	Started     time.Time `json:"started"`
+	LastPoll    time.Time `json:"last_poll"`
+	TipHeight   uint      `json:"tip_height"`
+	LastHeight  uint      `json:"last_height"`  // highest downloaded height
+	FinalHeight uint      `json:"final_height"` // highest finalized height
+	Lag         int       `json:"lag"`          // blocks behind the tip
+	Downloaded  int       `json:"downloaded"`
+	Failed      int       `json:"failed"`
+	PollErrors  int       `json:"poll_errors"`
+	Reorgs      int       `json:"reorgs"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Follower polls the source for the chain tip and downloads new blocks as
+// they appear. A block is finalized once it has `confirmations`
+// confirmations and links up with the blocks below it.
+type Follower struct {
+	crawler       *Crawler
+	poll          time.Duration // how often to ask for the tip
+	confirmations int
+	maxReorg      int
+	from          uint // first height if nothing saved yet, the tip if 0
+
+	mu     sync.Mutex
+	status FollowStatus
+}
+
+func NewFollower(crawler *Crawler, poll time.Duration, confirmations int, maxReorg int, from uint) *Follower {
+	if confirmations < 1 {
+		confirmations = 1
+	}
+	return &Follower{
+		crawler:       crawler,
+		poll:          poll,
+		confirmations: confirmations,
+		maxReorg:      maxReorg,
+		from:          from,
+		status:        FollowStatus{Started: time.Now()},
+	}
+}
+
+func (f *Follower) Status() FollowStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+func (f *Follower) update(fn func(s *FollowStatus)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(&f.status)
+}
+
+func (f *Follower) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	obj, _ := json.MarshalIndent(f.Status(), "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(obj)
+}
+
+// Run polls until ctx is done, a failed poll is counted and retried at
+// the next poll.
+func (f *Follower) Run(ctx context.Context) {
+	f.loadFinalized()
+	for {
+		if err := f.once(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("WARN: follow: %v\n", summary(err))
+			f.update(func(s *FollowStatus) {
+				s.PollErrors++
+				s.LastError = summary(err)
+			})
+		}
+		timer := time.NewTimer(f.poll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (f *Follower) once(ctx context.Context) error {
+	c := f.crawler
+	tip, err := c.source.GetTipHeight(ctx)
+	if err != nil {
+		return err
+	}
+	f.update(func(s *FollowStatus) {
+		s.LastPoll = time.Now()
+		s.TipHeight = uint(tip)
+	})
+	from := f.from
+	if from == 0 && len(c.headers.Heights()) == 0 {
+		from = uint(tip)
+	}
+	blocks, event, err := c.syncTo(ctx, from, uint(tip), f.maxReorg)
+	var behind *SourceBehindError
+	if errors.As(err, &behind) {
+		// a lagging source is not a failure, poll again later
+		log.Printf("INFO: follow: %v\n", err)
+		return nil
+	}
+	if event != nil {
+		f.update(func(s *FollowStatus) { s.Reorgs++ })
+		// blocks finalized above the fork were not final after all
+		if event.ForkHeight < f.Status().FinalHeight {
+			log.Printf("WARN: reorg below finalized height %d, consider more confirmations\n", f.Status().FinalHeight)
+			f.setFinalized(event.ForkHeight)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(blocks) > 0 {
+		// the pool handles Ctrl-C by itself, do not cancel running blocks
+		success, failed := c.DownloadAllBlocks(context.Background(), blocks)
+		f.update(func(s *FollowStatus) {
+			s.Downloaded += success
+			s.Failed += len(failed)
+		})
+	}
+	if heights := c.headers.Heights(); len(heights) > 0 {
+		last := heights[len(heights)-1]
+		f.update(func(s *FollowStatus) {
+			s.LastHeight = last
+			s.Lag = tip - int(last)
+		})
+	}
+	return f.finalize(uint(tip))
+}
+
+// finalize advances the finalized height to blocks with enough
+// confirmations, stopping at the first height failing chain verification.
+func (f *Follower) finalize(tip uint) error {
+	if tip+1 < uint(f.confirmations) {
+		return nil
+	}
+	target := tip + 1 - uint(f.confirmations)
+	status := f.Status()
+	if target > status.LastHeight {
+		target = status.LastHeight
+	}
+	low := status.FinalHeight + 1
+	if status.FinalHeight == 0 {
+		heights := f.crawler.headers.Heights()
+		if len(heights) == 0 {
+			return nil
+		}
+		low = heights[0]
+	}
+	if target < low {
+		return nil
+	}
+	final := target
+	if issues := VerifyChain(f.crawler.headers, low, target); len(issues) > 0 {
+		reportChain(issues, low, target)
+		if issues[0].Height <= low {
+			return errors.New(fmt.Sprintf("cannot finalize height %d: %v", low, issues[0]))
+		}
+		final = issues[0].Height - 1
+	}
+	log.Printf("Follow: finalized heights %d-%d\n", low, final)
+	return f.setFinalized(final)
+}
+
+func (f *Follower) setFinalized(height uint) error {
+	f.update(func(s *FollowStatus) { s.FinalHeight = height })
+	path := filepath.Join(f.crawler.savedir, finalizedFile)
+	content := []byte(fmt.Sprintf("%d\n", height))
+	return fs.Save(path, content, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+}
+
+func (f *Follower) loadFinalized() {
+	content, err := os.ReadFile(filepath.Join(f.crawler.savedir, finalizedFile))
+	if err != nil {
+		return
+	}
+	if height, err := strconv.Atoi(strings.TrimSpace(string(content))); err == nil && height >= 0 {
+		f.update(func(s *FollowStatus) { s.FinalHeight = uint(height) })
+	}
+}
@@ -0,0 +1,63 @@
+package net_learn
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFollowerReorg(t *testing.T) {
+	source := newPoolSource()
+	source.fork("a", 0, 5)
+	c := newPoolCrawler(t, source)
+	f := NewFollower(c, time.Minute, 2, 10, 1)
+	ctx := context.Background()
+
+	check := func(round string, last, final uint, reorgs int) {
+		t.Helper()
+		if err := f.once(ctx); err != nil {
+			t.Fatalf("%s: %+v", round, err)
+		}
+		s := f.Status()
+		if s.LastHeight != last || s.FinalHeight != final || s.Reorgs != reorgs || s.Failed != 0 {
+			t.Fatalf("%s: status %+v, want last %d, final %d, %d reorg(s)", round, s, last, final, reorgs)
+		}
+		content, err := os.ReadFile(filepath.Join(c.savedir, finalizedFile))
+		if err != nil || string(content) != fmt.Sprintf("%d\n", final) {
+			t.Fatalf("%s: %s is %q, %v", round, finalizedFile, content, err)
+		}
+	}
+	// 1-5 downloaded, 4 has 2 confirmations
+	check("first poll", 5, 4, 0)
+	if s := f.Status(); s.Downloaded != 5 || s.Lag != 0 {
+		t.Fatalf("downloaded %d with lag %d, want 5 and 0", s.Downloaded, s.Lag)
+	}
+
+	// 5 is replaced above the finalized height
+	source.fork("b", 5, 7)
+	check("reorg above final", 7, 6, 1)
+	if h, ok := c.headers.GetByHash("b5"); !ok || !h.Mainchain {
+		t.Fatalf("b5 is %+v, %v; want it saved in mainchain", h, ok)
+	}
+
+	// 6 was finalized too early, the finalized height goes back then on
+	source.fork("c", 6, 9)
+	check("reorg below final", 9, 8, 2)
+	if s := f.Status(); s.Downloaded != 12 {
+		t.Fatalf("downloaded %d blocks, want 12", s.Downloaded)
+	}
+
+	// a lagging source is no error and changes nothing
+	source.fork("c", 8, 8)
+	check("source behind", 9, 8, 2)
+
+	// the finalized height is kept across restarts
+	f = NewFollower(c, time.Minute, 2, 10, 1)
+	f.loadFinalized()
+	if s := f.Status(); s.FinalHeight != 8 {
+		t.Fatalf("loaded finalized height %d, want 8", s.FinalHeight)
+	}
+}
@@ -0,0 +1,83 @@
+package net_learn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/pkg/errors"
+)
+
+// HaskoinSource reads blocks from a haskoin-store API, whose json is the
+// format of Block and Transaction.
+type HaskoinSource struct {
+	getBlockUrl string // https://api.blockchain.info/haskoin-store/btc/block/heights?heights=%s&notx=false
+	getTxUrl    string // https://api.blockchain.info/haskoin-store/btc/transactions?txids=%s
+	getTipUrl   string // https://api.blockchain.info/haskoin-store/btc/block/best?notx=true
+	client      *Client
+}
+
+func NewHaskoinSource(base string, client *Client) *HaskoinSource {
+	base = strings.TrimRight(base, "/")
+	return &HaskoinSource{
+		getBlockUrl: base + "/block/heights?heights=%s&notx=false",
+		getTxUrl:    base + "/transactions?txids=%s",
+		getTipUrl:   base + "/block/best?notx=true",
+		client:      client,
+	}
+}
+
+func (s *HaskoinSource) GetBlocksByHeights(ctx context.Context, heights []int) ([]chain.Block, error) {
+	strs := make([]string, 0, len(heights))
+	for _, h := range heights {
+		strs = append(strs, strconv.Itoa(h))
+	}
+	url := fmt.Sprintf(s.getBlockUrl, strings.Join(strs, ","))
+	body, err := s.client.Get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	/* save response */
+	var blocks []chain.Block
+	err = json.Unmarshal(body, &blocks)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("unmarshall error, response is:\n %s", preview(body, 200)))
+		return nil, err
+	}
+	return blocks, nil
+}
+
+func (s *HaskoinSource) GetTxsByHashs(ctx context.Context, txids []string) ([]chain.Transaction, error) {
+	url := fmt.Sprintf(s.getTxUrl, strings.Join(txids, ","))
+	body, err := s.client.Get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	/* save response */
+	var txs []chain.Transaction
+	err = json.Unmarshal(body, &txs)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("unmarshall error, response is:\n %s", preview(body, 200)))
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (s *HaskoinSource) GetTipHeight(ctx context.Context) (int, error) {
+	body, err := s.client.Get(ctx, s.getTipUrl)
+	if err != nil {
+		return 0, err
+	}
+	var block chain.Block
+	err = json.Unmarshal(body, &block)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("unmarshall error, response is:\n %s", preview(body, 200)))
+		return 0, err
+	}
+	return int(block.Height), nil
+}
@@ -0,0 +1,239 @@
+package net_learn
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/pkg/errors"
+)
+
+const headersFile = "headers.jsonl"
+
+// Header is a Block without its txid list, saved for every downloaded block.
+type Header struct {
+	Hash      string       `json:"hash"`
+	Height    uint         `json:"height"`
+	Mainchain bool         `json:"mainchain"`
+	Previous  string       `json:"previous"`
+	Time      uint         `json:"time"`
+	Version   uint         `json:"version"`
+	Bits      uint         `json:"bits"`
+	Nonce     uint64       `json:"nonce"`
+	Size      uint         `json:"size"`
+	TxCount   int          `json:"tx_count"`
+	Merkle    string       `json:"merkle"`
+	Subsidy   chain.Amount `json:"subsidy"`
+	Fees      chain.Amount `json:"fees"`
+	Outputs   uint64       `json:"outputs"`
+	Weight    uint         `json:"weight"`
+	Reorged   bool         `json:"reorged,omitempty"` // orphaned and rolled back by sync
+}
+
+// BlockHeader is the header of b saved by the crawler.
+func BlockHeader(b *chain.Block) Header {
+	return Header{
+		Hash:      b.Hash,
+		Height:    b.Height,
+		Mainchain: b.Mainchain,
+		Previous:  b.Previous,
+		Time:      b.Time,
+		Version:   b.Version,
+		Bits:      b.Bits,
+		Nonce:     b.Nonce,
+		Size:      b.Size,
+		TxCount:   len(b.Tx),
+		Merkle:    b.Merkle,
+		Subsidy:   b.Subsidy,
+		Fees:      b.Fees,
+		Outputs:   b.Outputs,
+		Weight:    b.Weight,
+	}
+}
+
+// HeaderStore is an append-only log of block headers in the save directory,
+// one json object per line, indexed by height and hash in memory. A height
+// may hold several hashes after a fork, the last line of a hash wins.
+type HeaderStore struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	headers map[uint][]Header
+	hashes  map[string]uint // height of each block hash
+}
+
+func OpenHeaderStore(savedir string) (*HeaderStore, error) {
+	path := filepath.Join(savedir, headersFile)
+	if err := os.MkdirAll(savedir, 0766); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("create save directory `%s` failed", savedir))
+		return nil, err
+	}
+	s := &HeaderStore{path: path, headers: make(map[uint][]Header), hashes: make(map[string]uint)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("open header store `%s` failed", path))
+		return nil, err
+	}
+	s.file = file
+	return s, nil
+}
+
+// LoadHeaderStore reads the headers saved in savedir without creating or
+// opening anything for writing, Put fails on it.
+func LoadHeaderStore(savedir string) (*HeaderStore, error) {
+	s := &HeaderStore{path: filepath.Join(savedir, headersFile), headers: make(map[uint][]Header), hashes: make(map[string]uint)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *HeaderStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read header store `%s` failed", s.path))
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var h Header
+		// a crash may leave the last line half written, skip it
+		if err := json.Unmarshal(scanner.Bytes(), &h); err != nil || h.Hash == "" {
+			continue
+		}
+		s.set(h)
+	}
+	if err := scanner.Err(); err != nil {
+		err = errors.Wrap(err, "scanner error")
+		return err
+	}
+	return nil
+}
+
+func (s *HeaderStore) set(h Header) {
+	s.hashes[h.Hash] = h.Height
+	headers := s.headers[h.Height]
+	for i := range headers {
+		if headers[i].Hash == h.Hash {
+			headers[i] = h
+			return
+		}
+	}
+	s.headers[h.Height] = append(headers, h)
+}
+
+// Put records header h, nothing is written if the same header is stored.
+func (s *HeaderStore) Put(h Header) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, old := range s.headers[h.Height] {
+		if old == h {
+			return nil
+		}
+	}
+	if s.file == nil {
+		return errors.New(fmt.Sprintf("header store `%s` is read-only", s.path))
+	}
+	line, _ := json.Marshal(h)
+	line = append(line, '\n')
+	s.set(h)
+	if _, err := s.file.Write(line); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("write header store `%s` failed", s.path))
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Get returns all headers stored at height, more than one after a fork.
+func (s *HeaderStore) Get(height uint) []Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Header(nil), s.headers[height]...)
+}
+
+// GetByHash returns the header of block hash.
+func (s *HeaderStore) GetByHash(hash string) (Header, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	height, ok := s.hashes[hash]
+	if !ok {
+		return Header{}, false
+	}
+	for _, h := range s.headers[height] {
+		if h.Hash == hash {
+			return h, true
+		}
+	}
+	return Header{}, false
+}
+
+// Range returns headers of heights in [low, high] sorted by height, blocks
+// rolled back by sync are left out unless all is true.
+func (s *HeaderStore) Range(low, high uint, all bool) []Header {
+	var headers []Header
+	for _, height := range s.Heights() {
+		if height < low || height > high {
+			continue
+		}
+		for _, h := range s.Get(height) {
+			if all || !h.Reorged {
+				headers = append(headers, h)
+			}
+		}
+	}
+	return headers
+}
+
+// Heights returns sorted heights having headers.
+func (s *HeaderStore) Heights() []uint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	heights := make([]uint, 0, len(s.headers))
+	for h := range s.headers {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights
+}
+
+// PrintHeaders writes headers as a table, interval is the seconds since the
+// block listed before it if that is the block below.
+func PrintHeaders(w io.Writer, headers []Header) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HEIGHT\tHASH\tTIME\tINTERVAL\tTXS\tSIZE\tWEIGHT\tFEES\tSUBSIDY\tBITS\tNONCE\tMAINCHAIN")
+	for i, h := range headers {
+		interval := "-"
+		if i > 0 && headers[i-1].Height+1 == h.Height && headers[i-1].Hash == h.Previous {
+			interval = strconv.Itoa(int(h.Time) - int(headers[i-1].Time))
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t%x\t%d\t%t\n",
+			h.Height, h.Hash, time.Unix(int64(h.Time), 0).UTC().Format("2006-01-02 15:04:05"), interval,
+			h.TxCount, h.Size, h.Weight, h.Fees, h.Subsidy, h.Bits, h.Nonce, h.Mainchain && !h.Reorged)
+	}
+	return tw.Flush()
+}
+
+func (s *HeaderStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
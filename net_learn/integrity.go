@@ -0,0 +1,119 @@
+package net_learn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/pkg/errors"
+)
+
+// IntegrityError is a downloaded block which does not match its header,
+// the block is downloaded again from scratch.
+type IntegrityError struct {
+	Height uint
+	Reason string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("block %d failed integrity check: %s", e.Height, e.Reason)
+}
+
+func doubleSha256(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// reverse byte order between rpc hex and internal hash order
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// MerkleRoot computes the merkle root of txids in block order. Txids and
+// the root are hex in rpc byte order, hashing is done in internal order.
+func MerkleRoot(txids []string) (string, error) {
+	if len(txids) == 0 {
+		return "", errors.New("no txid to compute merkle root")
+	}
+	level := make([][]byte, 0, len(txids))
+	for _, txid := range txids {
+		hash, err := hex.DecodeString(txid)
+		if err != nil || len(hash) != sha256.Size {
+			return "", errors.New(fmt.Sprintf("invalid txid `%s`", txid))
+		}
+		level = append(level, reverseBytes(hash))
+	}
+	for len(level) > 1 {
+		// odd level duplicates its last hash
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([][]byte, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			pair := append(append([]byte{}, level[i]...), level[i+1]...)
+			next = append(next, doubleSha256(pair))
+		}
+		level = next
+	}
+	return hex.EncodeToString(reverseBytes(level[0])), nil
+}
+
+// checkMerkle compares merkle root of block.Tx with block.Merkle, blocks
+// from a source without merkle root are not checked.
+func checkMerkle(block *chain.Block) error {
+	if block.Merkle == "" {
+		return nil
+	}
+	root, err := MerkleRoot(block.Tx)
+	if err != nil {
+		return &IntegrityError{Height: block.Height, Reason: err.Error()}
+	}
+	if root != block.Merkle {
+		return &IntegrityError{Height: block.Height,
+			Reason: fmt.Sprintf("merkle root of txids is %s, header says %s", root, block.Merkle)}
+	}
+	return nil
+}
+
+// checkBlockFile checks every txid of block.Tx is saved exactly once in
+// the block file at path, in block position order.
+func checkBlockFile(path string, block *chain.Block) error {
+	content, err := fs.ReadBlock(path)
+	if err != nil {
+		return err
+	}
+	var txs []struct {
+		Txid  string `json:"txid"`
+		Block struct {
+			Position uint `json:"position"`
+		} `json:"block"`
+	}
+	if err := json.Unmarshal(content, &txs); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("unmarshall %s error", path))
+		return err
+	}
+	if len(txs) != len(block.Tx) {
+		return &IntegrityError{Height: block.Height,
+			Reason: fmt.Sprintf("%d txs saved, block has %d", len(txs), len(block.Tx))}
+	}
+	seen := make(map[string]bool, len(txs))
+	for i, tx := range txs {
+		if seen[tx.Txid] {
+			return &IntegrityError{Height: block.Height, Reason: fmt.Sprintf("tx %s saved twice", tx.Txid)}
+		}
+		seen[tx.Txid] = true
+		if tx.Txid != block.Tx[i] || tx.Block.Position != uint(i) {
+			return &IntegrityError{Height: block.Height,
+				Reason: fmt.Sprintf("tx %s saved at %d with position %d, block has %s there", tx.Txid, i, tx.Block.Position, block.Tx[i])}
+		}
+	}
+	return nil
+}
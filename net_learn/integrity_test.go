@@ -0,0 +1,95 @@
+package net_learn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	content, err := os.ReadFile("../chain/testdata/block_170.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block chain.Block
+	if err := json.Unmarshal(content, &block); err != nil {
+		t.Fatal(err)
+	}
+	root, err := MerkleRoot(block.Tx)
+	if err != nil || root != "7dac2c5666815c17a3b36427de37bb9d2e2c5ccec3f8633eb91a4205cb4c10ff" {
+		t.Errorf("root of block 170 is %s, %v", root, err)
+	}
+	if err := checkMerkle(&block); err != nil {
+		t.Errorf("block 170: %v", err)
+	}
+
+	// the root of a block with only the coinbase is its txid, genesis here
+	genesis := "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+	if root, err := MerkleRoot([]string{genesis}); err != nil || root != genesis {
+		t.Errorf("root of genesis is %s, %v", root, err)
+	}
+
+	// an odd level pairs its last hash with itself
+	txids := []string{strings.Repeat("11", 32), strings.Repeat("22", 32), strings.Repeat("33", 32)}
+	odd, err := MerkleRoot(txids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	even, _ := MerkleRoot(append(txids, txids[2]))
+	if odd != even {
+		t.Errorf("root of 3 txs is %s, want %s of the last one repeated", odd, even)
+	}
+	swapped, _ := MerkleRoot([]string{txids[1], txids[0], txids[2]})
+	if swapped == odd {
+		t.Error("root does not depend on tx order")
+	}
+
+	for _, bad := range [][]string{nil, {"zz"}, {strings.Repeat("11", 31)}} {
+		if _, err := MerkleRoot(bad); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+	block.Tx[0], block.Tx[1] = block.Tx[1], block.Tx[0]
+	var integrityErr *IntegrityError
+	if err := checkMerkle(&block); !errors.As(err, &integrityErr) {
+		t.Errorf("swapped txs of block 170: %v, want an integrity error", err)
+	}
+}
+
+func TestCheckBlockFile(t *testing.T) {
+	block := &chain.Block{Height: 9, Tx: []string{"a", "b", "c"}}
+	tx := func(txid string, position int) string {
+		return fmt.Sprintf(`{"txid":%q,"block":{"height":9,"position":%d}}`, txid, position)
+	}
+	tests := []struct {
+		name  string
+		txs   []string
+		valid bool
+	}{
+		{"complete", []string{tx("a", 0), tx("b", 1), tx("c", 2)}, true},
+		{"missing", []string{tx("a", 0), tx("b", 1)}, false},
+		{"duplicated", []string{tx("a", 0), tx("a", 0), tx("c", 2)}, false},
+		{"out of order", []string{tx("a", 0), tx("c", 2), tx("b", 1)}, false},
+		{"wrong position", []string{tx("a", 0), tx("b", 2), tx("c", 1)}, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "block_height=9.json")
+		if err := os.WriteFile(path, []byte("["+strings.Join(test.txs, ",")+"]"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		err := checkBlockFile(path, block)
+		var integrityErr *IntegrityError
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && !errors.As(err, &integrityErr) {
+			t.Errorf("%s: %v, want an integrity error", test.name, err)
+		}
+	}
+}
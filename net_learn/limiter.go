@@ -0,0 +1,227 @@
+package net_learn
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenBucket allows `rate` requests per second with bursts of `burst`.
+// The rate is halved by SlowDown when the server pushes back and grows
+// back slowly to the configured rate by SpeedUp on successful responses.
+// A bucket with rate 0 does not limit, only pauses of SlowDown apply.
+type TokenBucket struct {
+	mu      sync.Mutex
+	rate    float64 // current tokens per second
+	maxRate float64 // configured tokens per second
+	minRate float64 // rate never goes below this
+	burst   float64
+	tokens  float64
+	last    time.Time
+	until   time.Time // no token is handed out before this time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:    rate,
+		maxRate: rate,
+		minRate: rate / 32,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve takes one token and returns how long the caller has to wait for it
+func (b *TokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	if b.maxRate <= 0 {
+		return b.until.Sub(now)
+	}
+	b.refill(now)
+	b.tokens--
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if pause := b.until.Sub(now); pause > wait {
+		wait = pause
+	}
+	return wait
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	wait := b.reserve()
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// SlowDown halves the rate and pauses the bucket for at least `pause`.
+func (b *TokenBucket) SlowDown(pause time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(pause); until.After(b.until) {
+		b.until = until
+	}
+	if b.maxRate <= 0 {
+		return
+	}
+	b.refill(time.Now())
+	b.rate /= 2
+	if b.rate < b.minRate {
+		b.rate = b.minRate
+	}
+	b.tokens = 0
+}
+
+// SpeedUp increases the rate by a tenth of the configured rate.
+func (b *TokenBucket) SpeedUp() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate >= b.maxRate {
+		return
+	}
+	b.refill(time.Now())
+	b.rate += b.maxRate / 10
+	if b.rate > b.maxRate {
+		b.rate = b.maxRate
+	}
+}
+
+func (b *TokenBucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// Limiter holds one token bucket per API host, shared by all requests of
+// the crawler no matter which worker issues them.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64 // default rate of hosts not configured
+	burst   int     // default burst of hosts not configured
+	conf    map[string]HostRate
+	buckets map[string]*TokenBucket
+}
+
+type HostRate struct {
+	Rate  float64
+	Burst int
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		conf:    make(map[string]HostRate),
+		buckets: make(map[string]*TokenBucket),
+	}
+}
+
+func (l *Limiter) SetHost(host string, conf HostRate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conf[host] = conf
+	delete(l.buckets, host)
+}
+
+// Unlimit lets requests to host through without waiting, unless a rate
+// was set for it by SetHost.
+func (l *Limiter) Unlimit(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.conf[host]; ok {
+		return
+	}
+	l.conf[host] = HostRate{}
+	delete(l.buckets, host)
+}
+
+func (l *Limiter) Bucket(host string) *TokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[host]; ok {
+		return b
+	}
+	conf, ok := l.conf[host]
+	if !ok {
+		conf = HostRate{Rate: l.rate, Burst: l.burst}
+	}
+	b := NewTokenBucket(conf.Rate, conf.Burst)
+	l.buckets[host] = b
+	return b
+}
+
+// ParseHostRates parses `host=rate[:burst]` items given by `--host-rate`.
+func ParseHostRates(items []string) (map[string]HostRate, error) {
+	rates := make(map[string]HostRate)
+	for _, item := range items {
+		host, value := item, ""
+		if i := strings.Index(item, "="); i >= 0 {
+			host, value = item[:i], item[i+1:]
+		}
+		if host == "" || value == "" {
+			return nil, errors.New(fmt.Sprintf("invalid host rate `%s`, expect host=rate[:burst]", item))
+		}
+		conf := HostRate{Burst: 1}
+		rate_burst := strings.SplitN(value, ":", 2)
+		rate, err := strconv.ParseFloat(rate_burst[0], 64)
+		if err != nil || rate <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid rate in host rate `%s`", item))
+		}
+		conf.Rate = rate
+		if len(rate_burst) == 2 {
+			burst, err := strconv.Atoi(rate_burst[1])
+			if err != nil || burst < 1 {
+				return nil, errors.New(fmt.Sprintf("invalid burst in host rate `%s`", item))
+			}
+			conf.Burst = burst
+		}
+		rates[host] = conf
+	}
+	return rates, nil
+}
+
+// parse Retry-After header given in seconds, fallback to `def`
+func retryAfter(value string, def time.Duration) time.Duration {
+	if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := time.Parse(time.RFC1123, value); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+	return def
+}
+
+func logSlowDown(host string, reason string, b *TokenBucket) {
+	log.Printf("WARN: %s from %s, slow down to %.3f requests/s\n", reason, host, b.Rate())
+}
@@ -0,0 +1,130 @@
+package net_learn
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseHostRates(t *testing.T) {
+	rates, err := ParseHostRates([]string{"blockstream.info=2.5", "api.haskoin.com=10:4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]HostRate{
+		"blockstream.info": {Rate: 2.5, Burst: 1},
+		"api.haskoin.com":  {Rate: 10, Burst: 4},
+	}
+	if len(rates) != len(want) {
+		t.Fatalf("got %+v, want %+v", rates, want)
+	}
+	for host, conf := range want {
+		if rates[host] != conf {
+			t.Errorf("%s: got %+v, want %+v", host, rates[host], conf)
+		}
+	}
+
+	for _, item := range []string{
+		"blockstream.info",
+		"=2",
+		"blockstream.info=",
+		"blockstream.info=fast",
+		"blockstream.info=0",
+		"blockstream.info=-1",
+		"blockstream.info=2:0",
+		"blockstream.info=2:many",
+	} {
+		if _, err := ParseHostRates([]string{item}); err == nil {
+			t.Errorf("%q: no error", item)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	def := 7 * time.Second
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"30", 30 * time.Second, 30 * time.Second},
+		{" 5 ", 5 * time.Second, 5 * time.Second},
+		{future, 59 * time.Minute, time.Hour},
+		{"", def, def},
+		{"0", def, def},
+		{"-3", def, def},
+		{"soon", def, def},
+		{past, def, def},
+	}
+	for _, test := range tests {
+		if got := retryAfter(test.value, def); got < test.min || got > test.max {
+			t.Errorf("%q: got %s, want in [%s, %s]", test.value, got, test.min, test.max)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10, 2)
+	// the burst is handed out at once, then tokens come at the rate
+	if w := b.reserve(); w > 0 {
+		t.Errorf("first token waits %s", w)
+	}
+	if w := b.reserve(); w > 0 {
+		t.Errorf("second token waits %s", w)
+	}
+	if w := b.reserve(); w < 50*time.Millisecond || w > 100*time.Millisecond {
+		t.Errorf("third token waits %s, want about 100ms", w)
+	}
+
+	b.SlowDown(0)
+	if r := b.Rate(); r != 5 {
+		t.Errorf("rate after slow down is %v, want 5", r)
+	}
+	for i := 0; i < 20; i++ {
+		b.SlowDown(0)
+	}
+	if r := b.Rate(); r != 10.0/32 {
+		t.Errorf("rate after many slow downs is %v, want %v", r, 10.0/32)
+	}
+	for i := 0; i < 20; i++ {
+		b.SpeedUp()
+	}
+	if r := b.Rate(); r != 10 {
+		t.Errorf("rate after speed ups is %v, want 10", r)
+	}
+
+	// an unlimited bucket only waits for pauses
+	b = NewTokenBucket(0, 1)
+	for i := 0; i < 100; i++ {
+		if w := b.reserve(); w > 0 {
+			t.Fatalf("unlimited bucket waits %s", w)
+		}
+	}
+	b.SlowDown(time.Minute)
+	if w := b.reserve(); w < 59*time.Second {
+		t.Errorf("paused bucket waits %s, want about 1m", w)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wait of paused bucket returned %v, want deadline exceeded", err)
+	}
+}
+
+func TestLimiterBucket(t *testing.T) {
+	l := NewLimiter(3, 2)
+	l.SetHost("slow.example", HostRate{Rate: 1, Burst: 1})
+	l.Unlimit("slow.example")
+	l.Unlimit("local.example")
+	if b := l.Bucket("other.example"); b.Rate() != 3 || b != l.Bucket("other.example") {
+		t.Errorf("default bucket has rate %v or is not shared", b.Rate())
+	}
+	if r := l.Bucket("slow.example").Rate(); r != 1 {
+		t.Errorf("configured host has rate %v, want 1 kept over unlimit", r)
+	}
+	if r := l.Bucket("local.example").Rate(); r != 0 {
+		t.Errorf("unlimited host has rate %v, want 0", r)
+	}
+}
@@ -0,0 +1,294 @@
+package net_learn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+)
+
+// how often the scheduler prints progress of every worker
+const reportInterval = 30 * time.Second
+
+// blocks failing integrity check are downloaded again at most this times
+const maxRequeue = 1
+
+type job struct {
+	block    *chain.Block
+	requeued int // times the block has been queued again
+}
+
+type blockResult struct {
+	job
+	err error
+}
+
+type workerStatus struct {
+	height  uint
+	fetched int
+	total   int
+	blocks  int // number of blocks finished by this worker
+}
+
+// Progress tracks what each worker of the pool is downloading.
+type Progress struct {
+	mu      sync.Mutex
+	workers []workerStatus
+}
+
+func NewProgress(workers int) *Progress {
+	return &Progress{workers: make([]workerStatus, workers)}
+}
+
+func (p *Progress) Start(id int, block *chain.Block) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workers[id].height = block.Height
+	p.workers[id].fetched = 0
+	p.workers[id].total = len(block.Tx)
+}
+
+func (p *Progress) Add(id int, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workers[id].fetched += n
+}
+
+func (p *Progress) Finish(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workers[id].height = 0
+	p.workers[id].blocks++
+}
+
+func (p *Progress) Report() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, w := range p.workers {
+		if w.height == 0 {
+			log.Printf("[worker %d] idle, %d block(s) finished\n", id, w.blocks)
+			continue
+		}
+		log.Printf("[worker %d] block %d: %d/%d txs, %d block(s) finished\n", id, w.height, w.fetched, w.total, w.blocks)
+	}
+}
+
+// drop blocks whose file is already complete, used by `--resume`
+func (c *Crawler) skipFinished(blocks []chain.Block) []chain.Block {
+	var todo []chain.Block
+	for _, block := range blocks {
+		if IsBlockComplete(c.blockPath(block.Height), len(block.Tx)) {
+			if cp, ok := c.journal.State(int(block.Height)); !ok || cp.State != StateDone {
+				c.journal.Mark(int(block.Height), StateDone, nil)
+			}
+			// files downloaded before headers were kept
+			c.headers.Put(BlockHeader(&block))
+			continue
+		}
+		todo = append(todo, block)
+	}
+	log.Printf("Resume: %d of %d blocks already downloaded, skipped\n", len(blocks)-len(todo), len(blocks))
+	return todo
+}
+
+// refetch block of a requeued job, its txid list may be what went wrong
+func (c *Crawler) refetch(ctx context.Context, block *chain.Block) error {
+	var blocks []chain.Block
+	_, err := c.retry.Do(ctx, fmt.Sprintf("get block %d", block.Height), func() error {
+		var err error
+		blocks, err = c.source.GetBlocksByHeights(ctx, []int{int(block.Height)})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(blocks) != 1 {
+		return errors.New(fmt.Sprintf("got %d blocks at height %d, want 1", len(blocks), block.Height))
+	}
+	*block = blocks[0]
+	return nil
+}
+
+func (c *Crawler) worker(ctx context.Context, id int, queue <-chan job, results chan<- blockResult, progress *Progress) {
+	for j := range queue {
+		block := j.block
+		var err error
+		if j.requeued > 0 {
+			err = c.refetch(ctx, block)
+		}
+		progress.Start(id, block)
+		if err == nil {
+			err = c.DownloadOneBlock(ctx, block, func(n int) { progress.Add(id, n) })
+		}
+		if ctx.Err() != nil {
+			log.Printf("[worker %d] block %d interrupted, kept pending\n", id, block.Height)
+		} else if err != nil {
+			log.Printf("[worker %d] block %d failed: %+v\n", id, block.Height, err)
+		} else {
+			log.Printf("[worker %d] block %d download success!\n", id, block.Height)
+		}
+		progress.Finish(id)
+		results <- blockResult{job: j, err: err}
+	}
+}
+
+// DownloadAllBlocks downloads blocks with a pool of `c.workers` workers.
+// On the first Ctrl-C no more blocks are dispatched and running ones are
+// drained, undispatched blocks stay pending in the checkpoint journal.
+// A second Ctrl-C or the end of ctx cancels running blocks, they are put
+// back to pending too. It returns the number of blocks downloaded and the
+// heights which failed.
+func (c *Crawler) DownloadAllBlocks(ctx context.Context, blocks []chain.Block) (int, []int) {
+	if c.resume {
+		blocks = c.skipFinished(blocks)
+	}
+	for _, block := range blocks {
+		c.journal.Mark(int(block.Height), StatePending, nil)
+	}
+	n := len(blocks)
+	workers := c.workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n && n > 0 {
+		workers = n
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	draining := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(sig)
+		close(sig)
+	}()
+	go func() {
+		if _, ok := <-sig; !ok {
+			return
+		}
+		log.Println("Interrupted, waiting for running blocks to finish, press Ctrl-C again to stop them...")
+		close(draining)
+		if _, ok := <-sig; ok {
+			log.Println("Interrupted again, stopping running blocks...")
+			cancel()
+		}
+	}()
+
+	queue := make(chan job)
+	results := make(chan blockResult, workers)
+	requeue := make(chan job, n)
+	// closed when every block is finished, nothing will be requeued
+	allDone := make(chan struct{})
+	if n == 0 {
+		close(allDone)
+	}
+	progress := NewProgress(workers)
+	var wg sync.WaitGroup
+	for id := 0; id < workers; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			c.worker(ctx, id, queue, results, progress)
+		}(id)
+	}
+	go func() {
+		defer close(queue)
+		send := func(j job) bool {
+			select {
+			case queue <- j:
+				return true
+			case <-draining:
+			case <-ctx.Done():
+			}
+			return false
+		}
+		for i := range blocks {
+			if !send(job{block: &blocks[i]}) {
+				return
+			}
+		}
+		for {
+			select {
+			case j := <-requeue:
+				if !send(j) {
+					return
+				}
+			case <-allDone:
+				return
+			case <-draining:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	failedBlocks := make([]int, 0)
+	finished, interrupted := 0, 0
+	for results != nil {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				results = nil
+				break
+			}
+			if ctx.Err() != nil && errors.Is(r.err, ctx.Err()) {
+				interrupted++
+				break
+			}
+			var integrityErr *IntegrityError
+			if errors.As(r.err, &integrityErr) && r.requeued < maxRequeue {
+				log.Printf("Requeue block %d: %v\n", r.block.Height, r.err)
+				requeue <- job{block: r.block, requeued: r.requeued + 1}
+				break
+			}
+			finished++
+			if r.err != nil {
+				failedBlocks = append(failedBlocks, int(r.block.Height))
+			}
+			if finished == n {
+				close(allDone)
+			}
+		case <-ticker.C:
+			log.Printf("Progress: %d/%d blocks finished, %d failed\n", finished, n, len(failedBlocks))
+			progress.Report()
+		}
+	}
+
+	// requeued blocks never started again have failed
+	for len(requeue) > 0 {
+		j := <-requeue
+		finished++
+		failedBlocks = append(failedBlocks, int(j.block.Height))
+	}
+	log.Printf("Total : %d, Success: %d, Failure: %d, Interrupted: %d, Not started: %d\n",
+		n, finished-len(failedBlocks), len(failedBlocks), interrupted, n-finished-interrupted)
+	if len(failedBlocks) > 0 {
+		sort.Ints(failedBlocks)
+		log.Printf("Failed blocks are: %v\n", failedBlocks)
+		content := fmt.Sprintf("%v\n", failedBlocks)
+		content = content[1:len(content)-2] + "\n"
+		fs.Save("failed_block_heights.txt", []byte(content), os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+		log.Printf("Save failed block heights at: %s", "failed_block_heights.txt")
+	}
+	if n-finished > 0 {
+		log.Printf("%d blocks unfinished are kept pending, rerun with `--resume` to continue\n", n-finished)
+	}
+	return finished - len(failedBlocks), failedBlocks
+}
@@ -0,0 +1,260 @@
+package net_learn
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+)
+
+// poolSource serves blocks of fake txids, fetching txs waits for gate to
+// be closed when it is set.
+type poolSource struct {
+	blocks  map[int]chain.Block
+	started chan struct{} // gets a value each time txs are fetched
+	gate    chan struct{}
+	mu      sync.Mutex
+	gets    int // number of blocks asked for
+}
+
+func newPoolSource(heights ...int) *poolSource {
+	s := &poolSource{blocks: make(map[int]chain.Block), started: make(chan struct{}, 100)}
+	for _, h := range heights {
+		s.blocks[h] = poolBlock(fmt.Sprintf("h%d", h), h, "")
+	}
+	return s
+}
+
+// block of 3 fake txids with a matching merkle root
+func poolBlock(hash string, height int, previous string) chain.Block {
+	block := chain.Block{Hash: hash, Height: uint(height), Previous: previous, Mainchain: true}
+	for i := 0; i < 3; i++ {
+		block.Tx = append(block.Tx, fmt.Sprintf("%064x", height*100+i))
+	}
+	block.Merkle, _ = MerkleRoot(block.Tx)
+	return block
+}
+
+// fork replaces blocks from height `from` on with a branch named by prefix
+// up to tip, linked to the block below
+func (s *poolSource) fork(prefix string, from int, tip int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h := range s.blocks {
+		if h > tip {
+			delete(s.blocks, h)
+		}
+	}
+	for h := from; h <= tip; h++ {
+		s.blocks[h] = poolBlock(fmt.Sprintf("%s%d", prefix, h), h, s.blocks[h-1].Hash)
+	}
+}
+
+func (s *poolSource) GetBlocksByHeights(ctx context.Context, heights []int) ([]chain.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets += len(heights)
+	var blocks []chain.Block
+	for _, h := range heights {
+		block, ok := s.blocks[h]
+		if !ok {
+			return nil, &HTTPError{StatusCode: 404}
+		}
+		block.Tx = append([]string{}, block.Tx...)
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (s *poolSource) GetTxsByHashs(ctx context.Context, txids []string) ([]chain.Transaction, error) {
+	select {
+	case s.started <- struct{}{}:
+	default:
+	}
+	if s.gate != nil {
+		select {
+		case <-s.gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	txs := make([]chain.Transaction, len(txids))
+	for i, txid := range txids {
+		txs[i].Txid = txid
+	}
+	return txs, nil
+}
+
+func (s *poolSource) GetTipHeight(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.blocks) - 1, nil
+}
+
+// one worker crawler saving json blocks into a temp dir
+func newPoolCrawler(t *testing.T, source BlockSource) *Crawler {
+	dir := t.TempDir()
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { journal.Close() })
+	headers, err := OpenHeaderStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { headers.Close() })
+	ext, err := fs.BlockExt(fs.FormatJSON, fs.CompressNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Crawler{source: source, savedir: dir, page: 10, journal: journal, headers: headers, workers: 1,
+		retry: RetryPolicy{MaxAttempts: 1}, format: fs.FormatJSON, compress: fs.CompressNone, ext: ext}
+}
+
+// send Ctrl-C to the test itself, only while DownloadAllBlocks catches it
+func interrupt(t *testing.T) {
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(os.Interrupt)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func checkStates(t *testing.T, c *Crawler, want map[int]string) {
+	t.Helper()
+	for height, state := range want {
+		cp, ok := c.journal.State(height)
+		if !ok || cp.State != state {
+			t.Errorf("block %d is %q in journal, want %q", height, cp.State, state)
+		}
+	}
+}
+
+func TestDownloadAllBlocksDrain(t *testing.T) {
+	source := newPoolSource(0, 1, 2)
+	source.gate = make(chan struct{})
+	c := newPoolCrawler(t, source)
+	blocks, _ := source.GetBlocksByHeights(context.Background(), []int{0, 1, 2})
+
+	go func() {
+		<-source.started
+		interrupt(t)
+		// let the pool see the interrupt before block 0 finishes
+		time.Sleep(200 * time.Millisecond)
+		close(source.gate)
+	}()
+	downloaded, failed := c.DownloadAllBlocks(context.Background(), blocks)
+	if downloaded != 1 || len(failed) != 0 {
+		t.Fatalf("downloaded %d, failed %v; want 1 and none", downloaded, failed)
+	}
+	checkStates(t, c, map[int]string{0: StateDone, 1: StatePending, 2: StatePending})
+	if !IsBlockComplete(c.blockPath(0), 3) {
+		t.Error("block 0 was not saved")
+	}
+}
+
+func TestDownloadAllBlocksCancel(t *testing.T) {
+	source := newPoolSource(0, 1)
+	source.gate = make(chan struct{})
+	c := newPoolCrawler(t, source)
+	blocks, _ := source.GetBlocksByHeights(context.Background(), []int{0, 1})
+
+	go func() {
+		<-source.started
+		interrupt(t)
+		time.Sleep(200 * time.Millisecond)
+		interrupt(t)
+	}()
+	done := make(chan struct{})
+	var downloaded int
+	var failed []int
+	go func() {
+		defer close(done)
+		downloaded, failed = c.DownloadAllBlocks(context.Background(), blocks)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("running block was not canceled by the second interrupt")
+	}
+	if downloaded != 0 || len(failed) != 0 {
+		t.Fatalf("downloaded %d, failed %v; want none", downloaded, failed)
+	}
+	checkStates(t, c, map[int]string{0: StatePending, 1: StatePending})
+	if _, err := os.Stat(c.blockPath(0)); !os.IsNotExist(err) {
+		t.Errorf("canceled block 0 was saved: %v", err)
+	}
+}
+
+// run DownloadAllBlocks in a temp working dir, which gets the failed list
+func downloadInTempDir(t *testing.T, c *Crawler, blocks []chain.Block) (int, []int, string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	downloaded, failed := c.DownloadAllBlocks(context.Background(), blocks)
+	return downloaded, failed, dir
+}
+
+func TestDownloadAllBlocksRequeue(t *testing.T) {
+	// the header keeps a merkle root no txid list of the source matches
+	source := newPoolSource(0, 1)
+	bad := source.blocks[1]
+	bad.Merkle = strings.Repeat("0", 64)
+	source.blocks[1] = bad
+	c := newPoolCrawler(t, source)
+	blocks, _ := source.GetBlocksByHeights(context.Background(), []int{0, 1})
+	source.gets = 0
+
+	downloaded, failed, dir := downloadInTempDir(t, c, blocks)
+	if downloaded != 1 || len(failed) != 1 || failed[0] != 1 {
+		t.Fatalf("downloaded %d, failed %v; want 1 and [1]", downloaded, failed)
+	}
+	if source.gets != maxRequeue {
+		t.Errorf("block refetched %d times, want %d", source.gets, maxRequeue)
+	}
+	checkStates(t, c, map[int]string{0: StateDone, 1: StateFailed})
+	if cp, _ := c.journal.State(1); !strings.Contains(cp.Error, "merkle root") {
+		t.Errorf("journal error of block 1 is %q, want a merkle mismatch", cp.Error)
+	}
+	if _, err := os.Stat(c.blockPath(1)); !os.IsNotExist(err) {
+		t.Error("block 1 was kept though it does not match its header")
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "failed_block_heights.txt"))
+	if err != nil || string(content) != "1\n" {
+		t.Errorf("failed list is %q, %v; want 1", content, err)
+	}
+}
+
+func TestDownloadAllBlocksRequeueRefetch(t *testing.T) {
+	// txids given first are out of order, the refetched block is right
+	source := newPoolSource(0)
+	c := newPoolCrawler(t, source)
+	blocks, _ := source.GetBlocksByHeights(context.Background(), []int{0})
+	blocks[0].Tx[0], blocks[0].Tx[1] = blocks[0].Tx[1], blocks[0].Tx[0]
+	source.gets = 0
+
+	downloaded, failed, _ := downloadInTempDir(t, c, blocks)
+	if downloaded != 1 || len(failed) != 0 || source.gets != 1 {
+		t.Fatalf("downloaded %d, failed %v after %d refetch; want 1, none and 1", downloaded, failed, source.gets)
+	}
+	checkStates(t, c, map[int]string{0: StateDone})
+	if !IsBlockComplete(c.blockPath(0), 3) {
+		t.Error("block 0 was not saved")
+	}
+}
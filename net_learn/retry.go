@@ -0,0 +1,148 @@
+package net_learn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy retries retryable failures with exponential backoff, the
+// n-th retry waits about BaseDelay*2^(n-1) but never more than MaxDelay.
+// Jitter is the fraction of the delay randomized so workers throttled at
+// the same time do not retry at the same time.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 6,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    2 * time.Minute,
+	Jitter:      0.5,
+}
+
+// Delay returns how long to wait before the given retry, starting at 1.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	jitter := time.Duration(float64(d) * p.Jitter * rand.Float64())
+	return d - jitter
+}
+
+// Do calls fn until it succeeds, fails permanently, runs out of attempts
+// or ctx is done. It returns the number of attempts made and the last error.
+func (p RetryPolicy) Do(ctx context.Context, name string, fn func() error) (int, error) {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if err = fn(); err == nil {
+			return i, nil
+		}
+		// canceled from outside, the error is not about the request
+		if ctx.Err() != nil {
+			return i, ctx.Err()
+		}
+		if !IsRetryable(err) {
+			return i, err
+		}
+		if i < attempts {
+			d := p.Delay(i)
+			log.Printf("WARN: Retry %s for %d time(s) in %s: %v\n", name, i, d.Round(time.Millisecond), summary(err))
+			timer := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return i, ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	return attempts, err
+}
+
+// first line of error message for logs
+func summary(err error) string {
+	msg := err.Error()
+	if i := strings.Index(msg, "\n"); i >= 0 {
+		msg = msg[:i]
+	}
+	return msg
+}
+
+// IsRetryable tells whether retrying may fix err: timeouts, network errors,
+// throttling, 5xx and truncated or garbled json. Everything else such as
+// 404 or a bad txid is permanent.
+func IsRetryable(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		code := httpErr.StatusCode
+		return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500 ||
+			// html error page served with 200
+			code == http.StatusOK
+	}
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		// node is still warming up
+		return rpcErr.Code == -28
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	return false
+}
+
+// PageError is a page of txids which could not be downloaded.
+type PageError struct {
+	Height   uint
+	Txids    []string
+	Attempts int
+	Err      error
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("page of %d txs starting at %s in block %d failed after %d attempt(s): %v",
+		len(e.Txids), e.Txids[0], e.Height, e.Attempts, e.Err)
+}
+
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
+
+// BlockError lists the pages of a block which failed.
+type BlockError struct {
+	Height uint
+	Pages  []*PageError
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %d: %d page(s) failed, first: %v", e.Height, len(e.Pages), e.Pages[0])
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Pages[0]
+}
@@ -0,0 +1,449 @@
+package net_learn
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/pkg/errors"
+)
+
+// prev transactions looked up by one getrawtransaction batch
+const rpcBatchSize = 100
+
+// RPCSource reads blocks from a bitcoin core node through json-rpc, the
+// node needs `txindex=1` to look up transactions outside the wallet and
+// the prevouts of inputs.
+type RPCSource struct {
+	url    string
+	client *Client
+
+	mu         sync.Mutex
+	auth       string // value of Authorization header
+	cookiePath string // .cookie file of the node, reread when node restarts
+}
+
+type rpcRequest struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Id      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Id     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+type rpcBlockHeader struct {
+	Hash              string `json:"hash"`
+	Confirmations     int    `json:"confirmations"`
+	Height            uint   `json:"height"`
+	Version           uint   `json:"version"`
+	Merkleroot        string `json:"merkleroot"`
+	Time              uint   `json:"time"`
+	Nonce             uint64 `json:"nonce"`
+	Bits              string `json:"bits"`
+	Size              uint   `json:"size"`
+	Weight            uint   `json:"weight"`
+	Previousblockhash string `json:"previousblockhash"`
+}
+
+// getblock with verbosity 1
+type rpcBlock struct {
+	rpcBlockHeader
+	Tx []string `json:"tx"`
+}
+
+// getblock with verbosity 2
+type rpcVerboseBlock struct {
+	rpcBlockHeader
+	Tx []rpcTx `json:"tx"`
+}
+
+type rpcTx struct {
+	Txid     string `json:"txid"`
+	Version  uint   `json:"version"`
+	Size     uint   `json:"size"`
+	Weight   uint   `json:"weight"`
+	Locktime uint   `json:"locktime"`
+	Vin      []struct {
+		Coinbase  string `json:"coinbase"`
+		Txid      string `json:"txid"`
+		Vout      uint   `json:"vout"`
+		ScriptSig struct {
+			Hex string `json:"hex"`
+		} `json:"scriptSig"`
+		Txinwitness []string `json:"txinwitness"`
+		Sequence    uint64   `json:"sequence"`
+	} `json:"vin"`
+	Vout []struct {
+		Value        float64 `json:"value"`
+		N            uint    `json:"n"`
+		ScriptPubKey struct {
+			Hex       string   `json:"hex"`
+			Address   string   `json:"address"`
+			Addresses []string `json:"addresses"` // before bitcoin core 22
+		} `json:"scriptPubKey"`
+	} `json:"vout"`
+	Blockhash string `json:"blockhash"`
+	Blocktime uint   `json:"blocktime"`
+}
+
+// NewRPCSource authenticates with user and password if given, otherwise
+// with the cookie file written by the node.
+func NewRPCSource(url, user, password, cookiePath string, client *Client) *RPCSource {
+	s := &RPCSource{url: url, client: client}
+	if user != "" || password != "" {
+		s.auth = basicAuth(user, password)
+	} else {
+		s.cookiePath = cookiePath
+	}
+	return s
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// default cookie file of bitcoin core on mainnet
+func defaultCookiePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".bitcoin", ".cookie")
+}
+
+// cookie file holds `__cookie__:password`, a new one is written each time
+// the node starts
+func (s *RPCSource) readCookie() error {
+	content, err := os.ReadFile(s.cookiePath)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read rpc cookie file `%s` failed", s.cookiePath))
+		return err
+	}
+	cookie := strings.TrimSpace(string(content))
+	i := strings.Index(cookie, ":")
+	if i < 0 {
+		return errors.New(fmt.Sprintf("invalid rpc cookie file `%s`", s.cookiePath))
+	}
+	s.auth = basicAuth(cookie[:i], cookie[i+1:])
+	return nil
+}
+
+func (s *RPCSource) authorization(reload bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cookiePath != "" && (s.auth == "" || reload) {
+		if err := s.readCookie(); err != nil {
+			return "", err
+		}
+	}
+	return s.auth, nil
+}
+
+// batch issues all requests in one json-rpc batch call, results are in the
+// same order as requests.
+func (s *RPCSource) batch(ctx context.Context, reqs []rpcRequest) ([]json.RawMessage, error) {
+	for i := range reqs {
+		reqs[i].Jsonrpc = "1.0"
+		reqs[i].Id = i
+	}
+	content, err := json.Marshal(reqs)
+	if err != nil {
+		err = errors.Wrap(err, "Marshal Error")
+		return nil, err
+	}
+	body, err := s.post(ctx, content, false)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized && s.cookiePath != "" {
+		// node restarted with a new cookie
+		body, err = s.post(ctx, content, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resps []rpcResponse
+	err = json.Unmarshal(body, &resps)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("unmarshall error, response is:\n %s", preview(body, 200)))
+		return nil, err
+	}
+	results := make([]json.RawMessage, len(reqs))
+	for _, resp := range resps {
+		if resp.Id < 0 || resp.Id >= len(reqs) {
+			return nil, errors.New(fmt.Sprintf("unexpected rpc response id %d", resp.Id))
+		}
+		if resp.Error != nil {
+			return nil, errors.Wrap(resp.Error, fmt.Sprintf("%s %v failed", reqs[resp.Id].Method, reqs[resp.Id].Params))
+		}
+		results[resp.Id] = resp.Result
+	}
+	return results, nil
+}
+
+func (s *RPCSource) post(ctx context.Context, content []byte, reload bool) ([]byte, error) {
+	auth, err := s.authorization(reload)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if auth != "" {
+		header.Set("Authorization", auth)
+	}
+	return s.client.Post(ctx, s.url, content, header)
+}
+
+func (s *RPCSource) call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	results, err := s.batch(ctx, []rpcRequest{{Method: method, Params: params}})
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(results[0], result)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("unmarshall %s result error", method))
+		return err
+	}
+	return nil
+}
+
+func (s *RPCSource) GetBlocksByHeights(ctx context.Context, heights []int) ([]chain.Block, error) {
+	var blocks []chain.Block
+	for _, h := range heights {
+		var hash string
+		if err := s.call(ctx, "getblockhash", &hash, h); err != nil {
+			return nil, err
+		}
+		var b rpcBlock
+		if err := s.call(ctx, "getblock", &b, hash, 1); err != nil {
+			return nil, err
+		}
+		block := b.normalize()
+		block.Tx = b.Tx
+		if len(b.Tx) > 0 {
+			// the block hash finds the coinbase without txindex
+			var coinbase rpcTx
+			if err := s.call(ctx, "getrawtransaction", &coinbase, b.Tx[0], true, b.Hash); err != nil {
+				return nil, err
+			}
+			tx := coinbase.normalize()
+			fees, err := coinbaseFees(b.Height, &tx)
+			if err != nil {
+				return nil, err
+			}
+			block.Fees = fees
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (b *rpcBlockHeader) normalize() chain.Block {
+	bits, _ := strconv.ParseUint(b.Bits, 16, 32)
+	return chain.Block{
+		Hash:      b.Hash,
+		Height:    b.Height,
+		Mainchain: b.Confirmations >= 0,
+		Previous:  b.Previousblockhash,
+		Time:      b.Time,
+		Version:   b.Version,
+		Bits:      uint(bits),
+		Nonce:     b.Nonce,
+		Size:      b.Size,
+		Merkle:    b.Merkleroot,
+		Subsidy:   blockSubsidy(b.Height),
+		Weight:    b.Weight,
+	}
+}
+
+// GetBlockTxs decodes all transactions of block with `getblock` verbosity 2
+// and resolves their prevouts, block.Fees is filled from its coinbase.
+func (s *RPCSource) GetBlockTxs(ctx context.Context, block *chain.Block) ([]chain.Transaction, error) {
+	var b rpcVerboseBlock
+	if err := s.call(ctx, "getblock", &b, block.Hash, 2); err != nil {
+		return nil, err
+	}
+	txs := make([]chain.Transaction, 0, len(b.Tx))
+	for i := range b.Tx {
+		tx := b.Tx[i].normalize()
+		tx.Time = b.Time
+		tx.Block.Height = b.Height
+		tx.Block.Position = uint(i)
+		txs = append(txs, tx)
+	}
+	if err := s.resolvePrevouts(ctx, txs); err != nil {
+		return nil, err
+	}
+	if len(txs) > 0 {
+		fees, err := coinbaseFees(b.Height, &txs[0])
+		if err != nil {
+			return nil, err
+		}
+		block.Fees = fees
+	}
+	return txs, nil
+}
+
+func (s *RPCSource) GetTxsByHashs(ctx context.Context, txids []string) ([]chain.Transaction, error) {
+	txs, err := s.getRawTransactions(ctx, txids)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.resolvePrevouts(ctx, txs); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (s *RPCSource) getRawTransactions(ctx context.Context, txids []string) ([]chain.Transaction, error) {
+	var txs []chain.Transaction
+	for start := 0; start < len(txids); start += rpcBatchSize {
+		end := start + rpcBatchSize
+		if end > len(txids) {
+			end = len(txids)
+		}
+		reqs := make([]rpcRequest, 0, end-start)
+		for _, txid := range txids[start:end] {
+			reqs = append(reqs, rpcRequest{Method: "getrawtransaction", Params: []interface{}{txid, true}})
+		}
+		results, err := s.batch(ctx, reqs)
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range results {
+			var rtx rpcTx
+			if err := json.Unmarshal(result, &rtx); err != nil {
+				err = errors.Wrap(err, fmt.Sprintf("unmarshall transaction %s error", txids[start+i]))
+				return nil, err
+			}
+			txs = append(txs, rtx.normalize())
+		}
+	}
+	return txs, nil
+}
+
+// resolvePrevouts fills value, address and pkscript of inputs from the
+// outputs they spend, then computes fees. Prev transactions within txs are
+// used directly, others are looked up by getrawtransaction.
+func (s *RPCSource) resolvePrevouts(ctx context.Context, txs []chain.Transaction) error {
+	known := make(map[string]*chain.Transaction, len(txs))
+	for i := range txs {
+		known[txs[i].Txid] = &txs[i]
+	}
+	var missing []string
+	for _, tx := range txs {
+		for _, input := range tx.Inputs {
+			if input.Coinbase {
+				continue
+			}
+			if _, ok := known[input.Txid]; !ok {
+				known[input.Txid] = nil
+				missing = append(missing, input.Txid)
+			}
+		}
+	}
+	prevs, err := s.getRawTransactions(ctx, missing)
+	if err != nil {
+		return err
+	}
+	for i := range prevs {
+		known[prevs[i].Txid] = &prevs[i]
+	}
+
+	for i := range txs {
+		tx := &txs[i]
+		for j := range tx.Inputs {
+			input := &tx.Inputs[j]
+			if input.Coinbase {
+				continue
+			}
+			prev := known[input.Txid]
+			if prev == nil || int(input.Output) >= len(prev.Outputs) {
+				return errors.New(fmt.Sprintf("prevout %s:%d of tx %s not found", input.Txid, input.Output, tx.Txid))
+			}
+			output := prev.Outputs[input.Output]
+			input.Value = output.Value
+			input.Address = output.Address
+			input.Pkscript = output.Pkscript
+		}
+		if fee, err := tx.ComputedFee(); err == nil {
+			tx.Fee = fee
+		}
+	}
+	return nil
+}
+
+func (s *RPCSource) GetTipHeight(ctx context.Context) (int, error) {
+	var height int
+	if err := s.call(ctx, "getblockcount", &height); err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// convert btc amount given by rpc to satoshi
+func btcToSatoshi(value float64) chain.Amount {
+	return chain.Amount(math.Round(value * float64(chain.BTC)))
+}
+
+func (rtx *rpcTx) normalize() chain.Transaction {
+	tx := chain.Transaction{
+		Txid:     rtx.Txid,
+		Size:     rtx.Size,
+		Version:  rtx.Version,
+		Locktime: rtx.Locktime,
+		Time:     rtx.Blocktime,
+		Weight:   rtx.Weight,
+	}
+	for _, vin := range rtx.Vin {
+		input := chain.TxInput{
+			Coinbase: vin.Coinbase != "",
+			Sequence: vin.Sequence,
+			Witness:  vin.Txinwitness,
+		}
+		if input.Coinbase {
+			input.Sigscript = vin.Coinbase
+		} else {
+			input.Txid = vin.Txid
+			input.Output = vin.Vout
+			input.Sigscript = vin.ScriptSig.Hex
+		}
+		if vin.Sequence < 0xfffffffe {
+			tx.Rbf = true
+		}
+		tx.Inputs = append(tx.Inputs, input)
+	}
+	for _, vout := range rtx.Vout {
+		output := chain.TxOutput{
+			Pkscript: vout.ScriptPubKey.Hex,
+			Value:    btcToSatoshi(vout.Value),
+			Address:  vout.ScriptPubKey.Address,
+		}
+		if output.Address == "" && len(vout.ScriptPubKey.Addresses) == 1 {
+			output.Address = vout.ScriptPubKey.Addresses[0]
+		}
+		tx.Outputs = append(tx.Outputs, output)
+	}
+	return tx
+}
@@ -0,0 +1,222 @@
+package net_learn
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+// coinbase tx of getrawtransaction verbose, paying value btc to address
+func rpcCoinbase(txid string, address string, value string) string {
+	return fmt.Sprintf(`{"txid":%q,"version":1,"size":100,"weight":400,"locktime":0,
+		"vin":[{"coinbase":"04ff","sequence":4294967295}],
+		"vout":[{"value":0,"n":0,"scriptPubKey":{"hex":"6a"}},{"value":%s,"n":1,"scriptPubKey":{"hex":"76","address":%q}}]}`,
+		txid, value, address)
+}
+
+func TestRPCBatchesRawTransactions(t *testing.T) {
+	srv := newRPCServer(t, "", func(method string, params []interface{}) (string, *RPCError) {
+		if method != "getrawtransaction" {
+			t.Errorf("unexpected %s", method)
+		}
+		return rpcCoinbase(params[0].(string), "1A", "1"), nil
+	})
+	src := NewRPCSource(srv.URL, "user", "pass", "", newTestClient())
+	txids := make([]string, 2*rpcBatchSize+50)
+	for i := range txids {
+		txids[i] = fmt.Sprintf("tx%03d", i)
+	}
+	txs, err := src.GetTxsByHashs(context.Background(), txids)
+	if err != nil {
+		t.Fatalf("GetTxsByHashs: %+v", err)
+	}
+	if len(txs) != len(txids) {
+		t.Fatalf("got %d txs, want %d", len(txs), len(txids))
+	}
+	for i, tx := range txs {
+		if tx.Txid != txids[i] {
+			t.Fatalf("tx %d is %s, want %s", i, tx.Txid, txids[i])
+		}
+	}
+	if posts, calls := srv.counts(); posts != 3 || calls != len(txids) {
+		t.Fatalf("%d requests with %d calls, want 3 with %d", posts, calls, len(txids))
+	}
+}
+
+func TestRPCBlockTxsResolvePrevouts(t *testing.T) {
+	block := `{"hash":"h1","confirmations":1,"height":1,"time":1231469665,"bits":"1d00ffff","previousblockhash":"h0","tx":[
+		{"txid":"c1","vin":[{"coinbase":"04ff","sequence":4294967295}],"vout":[{"value":50.00001,"n":0,"scriptPubKey":{"hex":"41","address":"1Miner"}}]},
+		{"txid":"t1","vin":[{"txid":"c1","vout":0,"scriptSig":{"hex":"47"},"sequence":4294967293},{"txid":"p0","vout":1,"scriptSig":{"hex":"47"},"sequence":4294967295}],
+		 "vout":[{"value":50.5,"n":0,"scriptPubKey":{"hex":"76","addresses":["1Bob"]}}]}]}`
+	srv := newRPCServer(t, "", func(method string, params []interface{}) (string, *RPCError) {
+		switch method {
+		case "getblock":
+			return block, nil
+		case "getrawtransaction":
+			return rpcCoinbase(params[0].(string), "1Alice", "0.5"), nil
+		}
+		return "", &RPCError{Code: -32601, Message: "Method not found"}
+	})
+	src := NewRPCSource(srv.URL, "user", "pass", "", newTestClient())
+	b := &chain.Block{Hash: "h1"}
+	txs, err := src.GetBlockTxs(context.Background(), b)
+	if err != nil {
+		t.Fatalf("GetBlockTxs: %+v", err)
+	}
+	tx := txs[1]
+	if tx.Block.Height != 1 || tx.Block.Position != 1 || tx.Time != 1231469665 || !tx.Rbf {
+		t.Fatalf("tx position = %+v", tx)
+	}
+	if tx.Inputs[0].Address != "1Miner" || tx.Inputs[0].Value != 5000001000 || tx.Inputs[1].Address != "1Alice" || tx.Inputs[1].Value != 50000000 {
+		t.Fatalf("inputs = %+v", tx.Inputs)
+	}
+	if tx.Outputs[0].Address != "1Bob" || tx.Fee != 1000 {
+		t.Fatalf("outputs %+v, fee %s", tx.Outputs, tx.Fee)
+	}
+	// the coinbase claims the fee of t1 beyond the subsidy
+	if b.Fees != 1000 {
+		t.Fatalf("block fees %s, want 1000", b.Fees)
+	}
+	// one getblock, one batch for the prevout outside the block
+	if posts, calls := srv.counts(); posts != 2 || calls != 2 {
+		t.Fatalf("%d requests with %d calls, want 2 with 2", posts, calls)
+	}
+}
+
+func TestRPCBlockFees(t *testing.T) {
+	srv := newRPCServer(t, "", func(method string, params []interface{}) (string, *RPCError) {
+		switch method {
+		case "getblockhash":
+			return `"h1"`, nil
+		case "getblock":
+			return `{"hash":"h1","confirmations":1,"height":210000,"bits":"1d00ffff","tx":["c1","t1"]}`, nil
+		case "getrawtransaction":
+			if len(params) != 3 || params[0] != "c1" || params[2] != "h1" {
+				t.Errorf("getrawtransaction %v, want the coinbase in block h1", params)
+			}
+			return rpcCoinbase("c1", "1Miner", "25.0002"), nil
+		}
+		return "", &RPCError{Code: -32601, Message: "Method not found"}
+	})
+	src := NewRPCSource(srv.URL, "user", "pass", "", newTestClient())
+	blocks, err := src.GetBlocksByHeights(context.Background(), []int{210000})
+	if err != nil {
+		t.Fatalf("GetBlocksByHeights: %+v", err)
+	}
+	if b := blocks[0]; b.Subsidy != 25*chain.BTC || b.Fees != 20000 {
+		t.Fatalf("subsidy %s, fees %s; want 25 btc and 20000", b.Subsidy, b.Fees)
+	}
+}
+
+func TestRPCReloadsCookieOn401(t *testing.T) {
+	cookie := filepath.Join(t.TempDir(), ".cookie")
+	if err := os.WriteFile(cookie, []byte("__cookie__:first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := newRPCServer(t, basicAuth("__cookie__", "first"), func(method string, params []interface{}) (string, *RPCError) {
+		return "7", nil
+	})
+	src := NewRPCSource(srv.URL, "", "", cookie, newTestClient())
+	ctx := context.Background()
+	if tip, err := src.GetTipHeight(ctx); err != nil || tip != 7 {
+		t.Fatalf("GetTipHeight = %d, %v", tip, err)
+	}
+
+	// node restarts with a new cookie
+	if err := os.WriteFile(cookie, []byte("__cookie__:second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	srv.auth = basicAuth("__cookie__", "second")
+	srv.mu.Unlock()
+	if tip, err := src.GetTipHeight(ctx); err != nil || tip != 7 {
+		t.Fatalf("GetTipHeight after restart = %d, %v", tip, err)
+	}
+	if posts, _ := srv.counts(); posts != 3 {
+		t.Fatalf("%d requests, want 3: ok, 401, ok after reload", posts)
+	}
+
+	// a stale cookie is reloaded once, not forever
+	srv.mu.Lock()
+	srv.auth = basicAuth("__cookie__", "third")
+	srv.mu.Unlock()
+	if _, err := src.GetTipHeight(ctx); err == nil {
+		t.Fatal("GetTipHeight succeeded with a stale cookie")
+	}
+	if posts, _ := srv.counts(); posts != 5 {
+		t.Fatalf("%d requests, want 5: 401 and 401 after reload", posts)
+	}
+}
+
+func TestRPCRetriesWarmUp(t *testing.T) {
+	warming := 2
+	srv := newRPCServer(t, "", func(method string, params []interface{}) (string, *RPCError) {
+		if warming > 0 {
+			warming--
+			return "", &RPCError{Code: -28, Message: "Loading block index..."}
+		}
+		return "812345", nil
+	})
+	src := NewRPCSource(srv.URL, "user", "pass", "", newTestClient())
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	var tip int
+	attempts, err := policy.Do(context.Background(), "get tip", func() error {
+		var err error
+		tip, err = src.GetTipHeight(context.Background())
+		return err
+	})
+	if err != nil || tip != 812345 || attempts != 3 {
+		t.Fatalf("tip %d after %d attempts, %v; want 812345 after 3", tip, attempts, err)
+	}
+
+	// other rpc errors are permanent
+	srv2 := newRPCServer(t, "", func(method string, params []interface{}) (string, *RPCError) {
+		return "", &RPCError{Code: -5, Message: "No such mempool or blockchain transaction"}
+	})
+	src = NewRPCSource(srv2.URL, "user", "pass", "", newTestClient())
+	attempts, err = policy.Do(context.Background(), "get tx", func() error {
+		_, err := src.GetTxsByHashs(context.Background(), []string{"nope"})
+		return err
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("%d attempts, %v; want 1 failed attempt", attempts, err)
+	}
+}
+
+func TestRPCNodeIsNotThrottled(t *testing.T) {
+	srv := newRPCServer(t, "", func(method string, params []interface{}) (string, *RPCError) {
+		return "1", nil
+	})
+	// one request per second for public APIs
+	client := &Client{limiter: NewLimiter(1, 1)}
+	src, err := NewSource(SourceOptions{Name: "rpc", Url: srv.URL, RPCUser: "user", RPCPassword: "pass"}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := src.GetTipHeight(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("10 rpc calls took %v, the node should not be limited", d)
+	}
+
+	// unless its host is given a rate
+	u, _ := url.Parse(srv.URL)
+	client.limiter = NewLimiter(1, 1)
+	client.limiter.SetHost(u.Host, HostRate{Rate: 1, Burst: 1})
+	if _, err := NewSource(SourceOptions{Name: "rpc", Url: srv.URL, RPCUser: "user", RPCPassword: "pass"}, client); err != nil {
+		t.Fatal(err)
+	}
+	if rate := client.limiter.Bucket(u.Host).Rate(); rate != 1 {
+		t.Fatalf("rate of the node is %v, want 1 given by --host-rate", rate)
+	}
+}
@@ -0,0 +1,97 @@
+package net_learn
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/kevin2li/go_learn/chain"
+	"github.com/pkg/errors"
+)
+
+// BlockSource is a blockchain data provider. Every implementation
+// normalizes its responses into Block and Transaction.
+type BlockSource interface {
+	// blocks with their txids at given heights
+	GetBlocksByHeights(ctx context.Context, heights []int) ([]chain.Block, error)
+	// transactions with given txids, in the same order
+	GetTxsByHashs(ctx context.Context, txids []string) ([]chain.Transaction, error)
+	// height of the best block
+	GetTipHeight(ctx context.Context) (int, error)
+}
+
+type SourceOptions struct {
+	Name        string // haskoin, esplora or rpc
+	Url         string // base url, default url of the source if empty
+	RPCUser     string
+	RPCPassword string
+	RPCCookie   string // cookie file used when user and password are empty
+}
+
+// BlockTxsSource is implemented by sources which can fetch all txs of a
+// block at once cheaper than page by page.
+type BlockTxsSource interface {
+	GetBlockTxs(ctx context.Context, block *chain.Block) ([]chain.Transaction, error)
+}
+
+const (
+	defaultHaskoinUrl = "https://api.blockchain.info/haskoin-store/btc"
+	defaultEsploraUrl = "https://blockstream.info/api"
+	defaultRPCUrl     = "http://127.0.0.1:8332"
+)
+
+func NewSource(opts SourceOptions, client *Client) (BlockSource, error) {
+	switch opts.Name {
+	case "haskoin", "":
+		if opts.Url == "" {
+			opts.Url = defaultHaskoinUrl
+		}
+		return NewHaskoinSource(opts.Url, client), nil
+	case "esplora":
+		if opts.Url == "" {
+			opts.Url = defaultEsploraUrl
+		}
+		return NewEsploraSource(opts.Url, client), nil
+	case "rpc":
+		if opts.Url == "" {
+			opts.Url = defaultRPCUrl
+		}
+		if opts.RPCCookie == "" {
+			opts.RPCCookie = defaultCookiePath()
+		}
+		// the node is our own, not a public API, throttle it only if
+		// `--host-rate` says so
+		if u, err := url.Parse(opts.Url); err == nil && client.limiter != nil {
+			client.limiter.Unlimit(u.Host)
+		}
+		return NewRPCSource(opts.Url, opts.RPCUser, opts.RPCPassword, opts.RPCCookie, client), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown source `%s`, should be one of haskoin, esplora, rpc", opts.Name))
+}
+
+// block reward in satoshi without fees, halving every 210000 blocks
+func blockSubsidy(height uint) chain.Amount {
+	halvings := height / 210000
+	if halvings >= 64 {
+		return 0
+	}
+	return (50 * chain.BTC) >> halvings
+}
+
+// coinbaseFees is what the coinbase claims beyond the subsidy. A miner may
+// claim less than it could, then fees are less than those paid.
+func coinbaseFees(height uint, coinbase *chain.Transaction) (chain.Amount, error) {
+	var claimed chain.Amount
+	for _, output := range coinbase.Outputs {
+		var err error
+		if claimed, err = claimed.Add(output.Value); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("coinbase %s of block %d", coinbase.Txid, height))
+			return 0, err
+		}
+	}
+	subsidy := blockSubsidy(height)
+	if claimed < subsidy {
+		return 0, nil
+	}
+	return claimed - subsidy, nil
+}
@@ -0,0 +1,251 @@
+package net_learn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+// client without throttling for stand-in servers
+func newTestClient() *Client {
+	return &Client{limiter: NewLimiter(1000, 100)}
+}
+
+// routes maps path with query to a canned response, missing ones are 404
+func newCannedServer(t *testing.T, routes map[string]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := routes[r.URL.RequestURI()]
+		if !ok {
+			t.Logf("unexpected request %s", r.URL.RequestURI())
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// rpcStandIn answers json-rpc batches like bitcoin core, each call by
+// handle. Requests without the wanted Authorization header get 401.
+type rpcStandIn struct {
+	*httptest.Server
+	mu    sync.Mutex
+	auth  string
+	posts int // http requests
+	calls int // rpc calls
+}
+
+func newRPCServer(t *testing.T, auth string, handle func(method string, params []interface{}) (string, *RPCError)) *rpcStandIn {
+	s := &rpcStandIn{auth: auth}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.posts++
+		want := s.auth
+		s.mu.Unlock()
+		if want != "" && r.Header.Get("Authorization") != want {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var reqs []rpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			t.Errorf("rpc request is not a batch: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resps := make([]map[string]interface{}, 0, len(reqs))
+		for _, req := range reqs {
+			s.mu.Lock()
+			s.calls++
+			s.mu.Unlock()
+			result, rpcErr := handle(req.Method, req.Params)
+			resp := map[string]interface{}{"id": req.Id, "result": json.RawMessage("null"), "error": nil}
+			if rpcErr != nil {
+				resp["error"] = rpcErr
+			} else {
+				resp["result"] = json.RawMessage(result)
+			}
+			resps = append(resps, resp)
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *rpcStandIn) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.posts, s.calls
+}
+
+const (
+	haskoinBlock = `{"hash":"h1","height":1,"mainchain":true,"previous":"h0","time":1231469665,"version":1,
+		"bits":486604799,"nonce":2573394689,"size":215,"tx":["c1","t1"],"merkle":"m1","subsidy":5000000000,
+		"fees":1000,"outputs":10000000000,"weight":860}`
+	haskoinCoinbase = `{"txid":"c1","size":134,"version":1,"locktime":0,"fee":0,
+		"inputs":[{"coinbase":true,"txid":"0000","output":4294967295,"sigscript":"04ff","sequence":4294967295,"pkscript":null,"value":0,"address":null,"witness":[]}],
+		"outputs":[{"address":"1Miner","pkscript":"41","value":5000001000,"spent":false}],
+		"block":{"height":1,"position":0},"deleted":false,"time":1231469665,"rbf":false,"weight":536}`
+	haskoinTx = `{"txid":"t1","size":225,"version":1,"locktime":0,"fee":1000,
+		"inputs":[{"coinbase":false,"txid":"p0","output":0,"sigscript":"47","sequence":4294967295,"pkscript":"76","value":101000,"address":"1Alice","witness":[]}],
+		"outputs":[{"address":"1Bob","pkscript":"76","value":100000,"spent":true,"spender":{"txid":"s1","input":0}}],
+		"block":{"height":1,"position":1},"deleted":false,"time":1231469665,"rbf":false,"weight":900}`
+)
+
+func TestHaskoinSource(t *testing.T) {
+	srv := newCannedServer(t, map[string]string{
+		"/block/heights?heights=1&notx=false": "[" + haskoinBlock + "]",
+		"/transactions?txids=c1,t1":           "[" + haskoinCoinbase + "," + haskoinTx + "]",
+		"/block/best?notx=true":               haskoinBlock,
+	})
+	src := NewHaskoinSource(srv.URL+"/", newTestClient())
+	ctx := context.Background()
+
+	blocks, err := src.GetBlocksByHeights(ctx, []int{1})
+	if err != nil {
+		t.Fatalf("GetBlocksByHeights: %+v", err)
+	}
+	if len(blocks) != 1 || blocks[0].Hash != "h1" || blocks[0].Fees != 1000 || len(blocks[0].Tx) != 2 {
+		t.Fatalf("GetBlocksByHeights = %+v", blocks)
+	}
+	txs, err := src.GetTxsByHashs(ctx, []string{"c1", "t1"})
+	if err != nil {
+		t.Fatalf("GetTxsByHashs: %+v", err)
+	}
+	if len(txs) != 2 || !txs[0].IsCoinbase() || txs[1].Inputs[0].Address != "1Alice" || txs[1].Fee != 1000 {
+		t.Fatalf("GetTxsByHashs = %+v", txs)
+	}
+	tip, err := src.GetTipHeight(ctx)
+	if err != nil || tip != 1 {
+		t.Fatalf("GetTipHeight = %d, %v", tip, err)
+	}
+}
+
+func TestHaskoinSourceBadResponse(t *testing.T) {
+	srv := newCannedServer(t, map[string]string{
+		"/transactions?txids=t1": `{"error":"not-found"}`,
+	})
+	src := NewHaskoinSource(srv.URL, newTestClient())
+	if _, err := src.GetTxsByHashs(context.Background(), []string{"t1"}); err == nil {
+		t.Fatal("GetTxsByHashs succeeded on an error object")
+	}
+}
+
+func TestEsploraSource(t *testing.T) {
+	srv := newCannedServer(t, map[string]string{
+		"/block-height/1": "h1\n",
+		"/block/h1": `{"id":"h1","height":1,"version":1,"timestamp":1231469665,"tx_count":2,"size":215,
+			"weight":860,"merkle_root":"m1","previousblockhash":"h0","nonce":2573394689,"bits":486604799}`,
+		"/block/h1/txids": `["c1","t1"]`,
+		"/tx/c1": `{"txid":"c1","version":1,"locktime":0,"size":134,"weight":536,"fee":0,
+			"vin":[{"txid":"0000","vout":4294967295,"prevout":null,"scriptsig":"04ff","is_coinbase":true,"sequence":4294967295}],
+			"vout":[{"scriptpubkey":"41","scriptpubkey_address":"1Miner","value":5000001000}],
+			"status":{"confirmed":true,"block_height":1,"block_hash":"h1","block_time":1231469665}}`,
+		"/tx/t1": `{"txid":"t1","version":2,"locktime":0,"size":225,"weight":900,"fee":1000,
+			"vin":[{"txid":"p0","vout":0,"prevout":{"scriptpubkey":"76","scriptpubkey_address":"1Alice","value":101000},
+				"scriptsig":"47","witness":["30"],"is_coinbase":false,"sequence":4294967293}],
+			"vout":[{"scriptpubkey":"76","scriptpubkey_address":"1Bob","value":100000}],
+			"status":{"confirmed":true,"block_height":1,"block_hash":"h1","block_time":1231469665}}`,
+		"/blocks/tip/height": "812345",
+	})
+	src := NewEsploraSource(srv.URL, newTestClient())
+	ctx := context.Background()
+
+	blocks, err := src.GetBlocksByHeights(ctx, []int{1})
+	if err != nil {
+		t.Fatalf("GetBlocksByHeights: %+v", err)
+	}
+	b := blocks[0]
+	if b.Hash != "h1" || b.Previous != "h0" || b.Merkle != "m1" || !b.Mainchain || len(b.Tx) != 2 {
+		t.Fatalf("GetBlocksByHeights = %+v", b)
+	}
+	if b.Subsidy != 50*chain.BTC || b.Fees != 1000 {
+		t.Fatalf("subsidy %s, fees %s, want 50 BTC and 1000 sat", b.Subsidy, b.Fees)
+	}
+	txs, err := src.GetTxsByHashs(ctx, []string{"c1", "t1"})
+	if err != nil {
+		t.Fatalf("GetTxsByHashs: %+v", err)
+	}
+	if !txs[0].IsCoinbase() || txs[0].Inputs[0].Txid != "" {
+		t.Fatalf("coinbase = %+v", txs[0])
+	}
+	tx := txs[1]
+	if tx.Inputs[0].Address != "1Alice" || tx.Inputs[0].Value != 101000 || tx.Outputs[0].Address != "1Bob" ||
+		tx.Fee != 1000 || !tx.Rbf || tx.Block.Height != 1 || tx.Time != 1231469665 {
+		t.Fatalf("tx = %+v", tx)
+	}
+	tip, err := src.GetTipHeight(ctx)
+	if err != nil || tip != 812345 {
+		t.Fatalf("GetTipHeight = %d, %v", tip, err)
+	}
+}
+
+func TestEsploraSourceNotFound(t *testing.T) {
+	srv := newCannedServer(t, nil)
+	src := NewEsploraSource(srv.URL, newTestClient())
+	_, err := src.GetTxsByHashs(context.Background(), []string{"nope"})
+	if err == nil || IsRetryable(err) {
+		t.Fatalf("GetTxsByHashs error = %v, want a permanent error", err)
+	}
+}
+
+func TestRPCSource(t *testing.T) {
+	results := map[string]string{
+		"getblockhash":  `"h1"`,
+		"getblock":      `{"hash":"h1","confirmations":3,"height":1,"version":1,"merkleroot":"m1","time":1231469665,"nonce":2573394689,"bits":"1d00ffff","size":215,"weight":860,"previousblockhash":"h0","tx":["c1","t1"]}`,
+		"getblockcount": `812345`,
+		"getrawtransaction": `{"txid":"p0","version":1,"size":100,"weight":400,"locktime":0,
+			"vin":[{"coinbase":"04ff","sequence":4294967295}],
+			"vout":[{"value":0.00101,"n":0,"scriptPubKey":{"hex":"76","address":"1Alice"}}]}`,
+	}
+	srv := newRPCServer(t, "", func(method string, params []interface{}) (string, *RPCError) {
+		return results[method], nil
+	})
+	src := NewRPCSource(srv.URL, "user", "pass", "", newTestClient())
+	ctx := context.Background()
+
+	blocks, err := src.GetBlocksByHeights(ctx, []int{1})
+	if err != nil {
+		t.Fatalf("GetBlocksByHeights: %+v", err)
+	}
+	b := blocks[0]
+	if b.Hash != "h1" || b.Bits != 0x1d00ffff || b.Previous != "h0" || !b.Mainchain || strings.Join(b.Tx, ",") != "c1,t1" {
+		t.Fatalf("GetBlocksByHeights = %+v", b)
+	}
+	txs, err := src.GetTxsByHashs(ctx, []string{"p0"})
+	if err != nil {
+		t.Fatalf("GetTxsByHashs: %+v", err)
+	}
+	if len(txs) != 1 || txs[0].Outputs[0].Value != 101000 || txs[0].Outputs[0].Address != "1Alice" {
+		t.Fatalf("GetTxsByHashs = %+v", txs)
+	}
+	tip, err := src.GetTipHeight(ctx)
+	if err != nil || tip != 812345 {
+		t.Fatalf("GetTipHeight = %d, %v", tip, err)
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	client := newTestClient()
+	for name, want := range map[string]string{"": "*net_learn.HaskoinSource", "haskoin": "*net_learn.HaskoinSource",
+		"esplora": "*net_learn.EsploraSource", "rpc": "*net_learn.RPCSource"} {
+		src, err := NewSource(SourceOptions{Name: name, RPCCookie: "/nonexistent"}, client)
+		if err != nil {
+			t.Fatalf("NewSource(%q): %v", name, err)
+		}
+		if got := fmt.Sprintf("%T", src); got != want {
+			t.Errorf("NewSource(%q) is %s, want %s", name, got, want)
+		}
+	}
+	if _, err := NewSource(SourceOptions{Name: "bogus"}, client); err == nil {
+		t.Error("NewSource(bogus) succeeded")
+	}
+}
@@ -0,0 +1,199 @@
+package net_learn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/pkg/errors"
+)
+
+const (
+	reorgDir        = "reorged"            // orphaned block files, one directory per block hash
+	reorgEventsFile = "reorg_events.jsonl" // reorgs found by sync, for downstream stores to roll back
+)
+
+// OrphanedBlock is a saved block which left the mainchain.
+type OrphanedBlock struct {
+	Height uint     `json:"height"`
+	Hash   string   `json:"hash"`
+	Files  []string `json:"files"` // where the block files are moved to
+}
+
+// ReorgEvent is appended to reorg_events.jsonl for every reorg, stores fed
+// with the orphaned block files should remove their txs.
+type ReorgEvent struct {
+	Time       int64           `json:"time"`
+	ForkHeight uint            `json:"fork_height"` // highest height still in mainchain
+	Orphaned   []OrphanedBlock `json:"orphaned"`
+}
+
+func (c *Crawler) getBlock(ctx context.Context, height uint) (*chain.Block, error) {
+	var blocks []chain.Block
+	_, err := c.retry.Do(ctx, fmt.Sprintf("get block %d", height), func() error {
+		var err error
+		blocks, err = c.source.GetBlocksByHeights(ctx, []int{int(height)})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) != 1 {
+		return nil, errors.New(fmt.Sprintf("got %d blocks at height %d, want 1", len(blocks), height))
+	}
+	return &blocks[0], nil
+}
+
+// savedMainHeader is the header saved as mainchain at height
+func (c *Crawler) savedMainHeader(height uint) (Header, bool) {
+	h, ok := mainHeader(c.headers.Get(height))
+	if !ok || !h.Mainchain {
+		return Header{}, false
+	}
+	return h, true
+}
+
+// SourceBehindError is a source whose tip is below the highest saved
+// height. Saved blocks above its tip can not be checked yet, sync waits for
+// the source to catch up rather than taking them as orphaned.
+type SourceBehindError struct {
+	Tip uint
+	Top uint
+}
+
+func (e *SourceBehindError) Error() string {
+	return fmt.Sprintf("source tip %d is below saved height %d, wait for it to catch up", e.Tip, e.Top)
+}
+
+// findFork walks down from the highest saved height until the saved block
+// is the block of the canonical chain. It returns that height and saved
+// blocks above it which left the mainchain. Only blocks whose hash differs
+// from the canonical one are orphaned, so top must not be above tip.
+func (c *Crawler) findFork(ctx context.Context, top uint, tip uint, maxDepth int) (uint, []Header, error) {
+	if top > tip {
+		return 0, nil, &SourceBehindError{Tip: tip, Top: top}
+	}
+	var orphaned []Header
+	for height := top; ; height-- {
+		if saved, ok := c.savedMainHeader(height); ok {
+			block, err := c.getBlock(ctx, height)
+			if err != nil {
+				return 0, nil, err
+			}
+			if block.Hash == saved.Hash {
+				return height, orphaned, nil
+			}
+			orphaned = append(orphaned, saved)
+		}
+		if top-height >= uint(maxDepth) {
+			return 0, nil, errors.New(fmt.Sprintf("no common block in %d heights below %d, reorg too deep", maxDepth, top))
+		}
+		if height == 0 {
+			return 0, nil, errors.New("no common block with the canonical chain")
+		}
+	}
+}
+
+// blockFiles lists saved files of height in any format
+func (c *Crawler) blockFiles(height uint) ([]string, error) {
+	pattern := filepath.Join(c.savedir, fmt.Sprintf("block_height=%d.*", height))
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, path := range paths {
+		if fs.IsBlockFile(filepath.Base(path)) {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// rollback moves files of orphaned blocks to `reorged/<hash>/`, marks their
+// headers reorged and heights pending, then records a ReorgEvent.
+func (c *Crawler) rollback(fork uint, orphaned []Header) (*ReorgEvent, error) {
+	event := &ReorgEvent{Time: time.Now().Unix(), ForkHeight: fork}
+	for _, h := range orphaned {
+		files, err := c.blockFiles(h.Height)
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(c.savedir, reorgDir, h.Hash)
+		if err := os.MkdirAll(dir, 0766); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("create directory `%s` failed", dir))
+			return nil, err
+		}
+		block := OrphanedBlock{Height: h.Height, Hash: h.Hash}
+		for _, path := range files {
+			target := filepath.Join(dir, filepath.Base(path))
+			if err := os.Rename(path, target); err != nil {
+				err = errors.Wrap(err, fmt.Sprintf("move `%s` to `%s` failed", path, target))
+				return nil, err
+			}
+			block.Files = append(block.Files, target)
+		}
+		h.Mainchain = false
+		h.Reorged = true
+		if err := c.headers.Put(h); err != nil {
+			return nil, err
+		}
+		c.journal.Mark(int(h.Height), StatePending, nil)
+		event.Orphaned = append(event.Orphaned, block)
+		log.Printf("Reorg: block %s at height %d orphaned, moved to %s\n", h.Hash, h.Height, dir)
+	}
+	line, _ := json.Marshal(event)
+	line = append(line, '\n')
+	path := filepath.Join(c.savedir, reorgEventsFile)
+	if err := fs.Save(path, line, os.O_CREATE|os.O_WRONLY|os.O_APPEND); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// SyncBlocks returns blocks to download to catch up with the chain tip.
+// Saved blocks orphaned by a reorg are rolled back first and their heights
+// downloaded again, the reorg is returned if any. An empty save directory
+// starts at `from`.
+func (c *Crawler) SyncBlocks(ctx context.Context, from uint, maxDepth int) ([]chain.Block, *ReorgEvent, error) {
+	tip, err := c.source.GetTipHeight(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.syncTo(ctx, from, uint(tip), maxDepth)
+}
+
+func (c *Crawler) syncTo(ctx context.Context, from uint, tip uint, maxDepth int) ([]chain.Block, *ReorgEvent, error) {
+	var event *ReorgEvent
+	start := from
+	if heights := c.headers.Heights(); len(heights) > 0 {
+		top := heights[len(heights)-1]
+		fork, orphaned, err := c.findFork(ctx, top, tip, maxDepth)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(orphaned) > 0 {
+			event, err = c.rollback(fork, orphaned)
+			if err != nil {
+				return nil, nil, err
+			}
+			log.Printf("Reorg: %d block(s) above height %d rolled back\n", len(event.Orphaned), event.ForkHeight)
+		}
+		if fork+1 > start {
+			start = fork + 1
+		}
+	}
+	if start > tip {
+		log.Printf("Sync: up to date at height %d\n", tip)
+		return nil, event, nil
+	}
+	log.Printf("Sync: heights %d-%d to download\n", start, tip)
+	blocks, err := c.GetBlocksInRange(ctx, int(start), int(tip)+1)
+	return blocks, event, err
+}
@@ -0,0 +1,88 @@
+package net_learn
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kevin2li/go_learn/chain"
+)
+
+// chainSource serves blocks of hashes by height, up to its tip
+type chainSource struct {
+	hashes []string
+}
+
+func (s *chainSource) GetBlocksByHeights(ctx context.Context, heights []int) ([]chain.Block, error) {
+	var blocks []chain.Block
+	for _, h := range heights {
+		if h >= len(s.hashes) {
+			return nil, &HTTPError{StatusCode: 404}
+		}
+		blocks = append(blocks, chain.Block{Hash: s.hashes[h], Height: uint(h), Mainchain: true})
+	}
+	return blocks, nil
+}
+
+func (s *chainSource) GetTxsByHashs(ctx context.Context, txids []string) ([]chain.Transaction, error) {
+	return nil, nil
+}
+
+func (s *chainSource) GetTipHeight(ctx context.Context) (int, error) {
+	return len(s.hashes) - 1, nil
+}
+
+// crawler with saved headers of hashes at heights 0..len(hashes)-1
+func newSyncCrawler(t *testing.T, source BlockSource, hashes []string) *Crawler {
+	headers, err := OpenHeaderStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { headers.Close() })
+	for height, hash := range hashes {
+		if err := headers.Put(Header{Hash: hash, Height: uint(height), Mainchain: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Crawler{source: source, headers: headers, retry: RetryPolicy{MaxAttempts: 1}}
+}
+
+func TestFindFork(t *testing.T) {
+	saved := []string{"a0", "a1", "a2", "a3"}
+	source := &chainSource{hashes: []string{"a0", "a1", "b2", "b3", "b4"}}
+	c := newSyncCrawler(t, source, saved)
+	fork, orphaned, err := c.findFork(context.Background(), 3, 4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork != 1 || len(orphaned) != 2 || orphaned[0].Hash != "a3" || orphaned[1].Hash != "a2" {
+		t.Fatalf("fork %d, orphaned %+v; want 1 and a3, a2", fork, orphaned)
+	}
+
+	if _, _, err := c.findFork(context.Background(), 3, 4, 1); err == nil {
+		t.Fatal("findFork found a fork deeper than max depth")
+	}
+}
+
+func TestFindForkSourceBehind(t *testing.T) {
+	saved := []string{"a0", "a1", "a2", "a3"}
+	// the source has not seen a2 and a3 yet, they are not orphaned
+	source := &chainSource{hashes: []string{"a0", "a1"}}
+	c := newSyncCrawler(t, source, saved)
+	_, orphaned, err := c.findFork(context.Background(), 3, 1, 10)
+	var behind *SourceBehindError
+	if !errors.As(err, &behind) || behind.Tip != 1 || behind.Top != 3 {
+		t.Fatalf("findFork error = %v, want source tip 1 below saved height 3", err)
+	}
+	if len(orphaned) > 0 {
+		t.Fatalf("orphaned %+v unchecked blocks", orphaned)
+	}
+
+	blocks, event, err := c.syncTo(context.Background(), 0, 1, 10)
+	if !errors.As(err, &behind) || event != nil || len(blocks) > 0 {
+		t.Fatalf("syncTo = %d blocks, %+v, %v; want to wait for the source", len(blocks), event, err)
+	}
+	if h, ok := c.savedMainHeader(3); !ok || h.Hash != "a3" {
+		t.Fatalf("saved header at 3 = %+v, %v; want a3 kept", h, ok)
+	}
+}
@@ -0,0 +1,104 @@
+package net_learn
+
+import (
+	"fmt"
+	"log"
+)
+
+// kinds of chain linkage issues
+const (
+	IssueGap    = "gap"    // no header saved at height
+	IssueFork   = "fork"   // several mainchain hashes saved at height
+	IssueOrphan = "orphan" // block saved at height is not in mainchain
+	IssueBroken = "broken" // previous hash does not match prior block
+)
+
+type LinkIssue struct {
+	Kind   string `json:"kind"`
+	Height uint   `json:"height"`
+	Hash   string `json:"hash,omitempty"`
+	Detail string `json:"detail"`
+}
+
+func (i LinkIssue) String() string {
+	return fmt.Sprintf("%s at height %d: %s", i.Kind, i.Height, i.Detail)
+}
+
+// drop headers of blocks rolled back by sync, they are known orphans
+func liveHeaders(headers []Header) []Header {
+	var live []Header
+	for _, h := range headers {
+		if !h.Reorged {
+			live = append(live, h)
+		}
+	}
+	return live
+}
+
+// mainHeader picks the header a height is linked by, the last mainchain
+// one or the last one if none is in mainchain.
+func mainHeader(headers []Header) (Header, bool) {
+	headers = liveHeaders(headers)
+	if len(headers) == 0 {
+		return Header{}, false
+	}
+	for i := len(headers) - 1; i >= 0; i-- {
+		if headers[i].Mainchain {
+			return headers[i], true
+		}
+	}
+	return headers[len(headers)-1], true
+}
+
+// VerifyChain checks saved headers of heights in [low, high]: every height
+// has a header, blocks are in mainchain, and each block's Previous is the
+// Hash of the block below it.
+func VerifyChain(store *HeaderStore, low, high uint) []LinkIssue {
+	var issues []LinkIssue
+	var prev Header
+	var hasPrev bool
+	if low > 0 {
+		prev, hasPrev = mainHeader(store.Get(low - 1))
+	}
+	for height := low; height <= high; height++ {
+		headers := liveHeaders(store.Get(height))
+		cur, ok := mainHeader(headers)
+		if !ok {
+			issues = append(issues, LinkIssue{Kind: IssueGap, Height: height, Detail: "no header saved"})
+			hasPrev = false
+			continue
+		}
+		var mains []string
+		for _, h := range headers {
+			if h.Mainchain {
+				mains = append(mains, h.Hash)
+			} else {
+				issues = append(issues, LinkIssue{Kind: IssueOrphan, Height: height, Hash: h.Hash,
+					Detail: fmt.Sprintf("block %s is not in mainchain", h.Hash)})
+			}
+		}
+		if len(mains) > 1 {
+			issues = append(issues, LinkIssue{Kind: IssueFork, Height: height, Hash: cur.Hash,
+				Detail: fmt.Sprintf("%d mainchain blocks saved: %v", len(mains), mains)})
+		}
+		if hasPrev && cur.Previous != prev.Hash {
+			issues = append(issues, LinkIssue{Kind: IssueBroken, Height: height, Hash: cur.Hash,
+				Detail: fmt.Sprintf("previous is %s, block at height %d is %s", cur.Previous, height-1, prev.Hash)})
+		}
+		prev, hasPrev = cur, true
+	}
+	return issues
+}
+
+// report issues found in [low, high], true if the chain is consistent
+func reportChain(issues []LinkIssue, low, high uint) bool {
+	for _, issue := range issues {
+		log.Printf("WARN: %v\n", issue)
+	}
+	if len(issues) > 0 {
+		log.Printf("Verify: %d issue(s) in heights %d-%d, do not analyze this range before fixing them\n", len(issues), low, high)
+		return false
+	}
+	log.Printf("Verify: heights %d-%d are linked in mainchain\n", low, high)
+	return true
+}
@@ -0,0 +1,220 @@
+package net_learn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+	"github.com/pkg/errors"
+)
+
+const (
+	partSuffix = ".part" // txs fetched so far, one json per line
+	tmpSuffix  = ".tmp"  // final file being assembled
+)
+
+type span struct {
+	offset int64
+	length int
+}
+
+// BlockWriter streams txs of one block into `<path>.part` page by page,
+// one json per line in the order they are fetched, so a failed or crashed
+// download keeps what it got and resumes page by page. Commit assembles
+// the block file in block order and renames it to `path` atomically.
+type BlockWriter struct {
+	path     string
+	format   string // json or jsonl
+	compress string // none, gzip or zstd
+	part     *os.File
+	spans    map[string]span // where each txid sits in part file
+	size     int64
+}
+
+// OpenBlockWriter opens the part file of path, existing txs in it are kept
+// if resume is true, otherwise it is truncated.
+func OpenBlockWriter(path string, format string, compress string, resume bool) (*BlockWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0766); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("create directory of `%s` failed", path))
+		return nil, err
+	}
+	flag := os.O_CREATE | os.O_RDWR
+	if !resume {
+		flag |= os.O_TRUNC
+	}
+	part, err := os.OpenFile(path+partSuffix, flag, 0666)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Open file `%s` error", path+partSuffix))
+		return nil, err
+	}
+	w := &BlockWriter{
+		path:     path,
+		format:   format,
+		compress: compress,
+		part:     part,
+		spans:    make(map[string]span),
+	}
+	if err := w.load(); err != nil {
+		part.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// load indexes complete lines of part file and cuts a half written tail
+func (w *BlockWriter) load() error {
+	reader := bufio.NewReader(w.part)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// no trailing newline, the last write did not finish
+			break
+		}
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("read `%s` failed", w.part.Name()))
+			return err
+		}
+		var tx struct {
+			Txid string `json:"txid"`
+		}
+		if json.Unmarshal(line, &tx) != nil || tx.Txid == "" {
+			break
+		}
+		w.spans[tx.Txid] = span{offset: offset, length: len(line) - 1}
+		offset += int64(len(line))
+	}
+	if err := w.part.Truncate(offset); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("truncate `%s` failed", w.part.Name()))
+		return err
+	}
+	if _, err := w.part.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = offset
+	return nil
+}
+
+func (w *BlockWriter) Has(txid string) bool {
+	_, ok := w.spans[txid]
+	return ok
+}
+
+func (w *BlockWriter) Count() int {
+	return len(w.spans)
+}
+
+// WritePage appends txs to part file and flushes them to disk.
+func (w *BlockWriter) WritePage(txs []chain.Transaction) error {
+	var buf bytes.Buffer
+	offset := w.size
+	added := make(map[string]span, len(txs))
+	for _, tx := range txs {
+		obj, err := json.Marshal(tx)
+		if err != nil {
+			err = errors.Wrap(err, "Marshal Error")
+			return err
+		}
+		added[tx.Txid] = span{offset: offset + int64(buf.Len()), length: len(obj)}
+		buf.Write(obj)
+		buf.WriteByte('\n')
+	}
+	if _, err := w.part.Write(buf.Bytes()); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("save file `%s` error", w.part.Name()))
+		return err
+	}
+	if err := w.part.Sync(); err != nil {
+		return err
+	}
+	w.size += int64(buf.Len())
+	for txid, s := range added {
+		w.spans[txid] = s
+	}
+	return nil
+}
+
+// Commit writes txs with given txids into `path` in the format and
+// compression of w, through a temp file renamed at the end, then removes
+// the part file.
+func (w *BlockWriter) Commit(txids []string) error {
+	tmp := w.path + tmpSuffix
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Open file `%s` error", tmp))
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	compressor, err := fs.NewWriter(writer, w.compress)
+	if err == nil {
+		err = w.writeTxs(compressor, txids)
+	}
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		err = errors.Wrap(err, fmt.Sprintf("save file `%s` error", tmp))
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("rename `%s` failed", tmp))
+		return err
+	}
+	w.part.Close()
+	return os.Remove(w.path + partSuffix)
+}
+
+// json array or json lines in the order of txids
+func (w *BlockWriter) writeTxs(writer io.Writer, txids []string) error {
+	open, sep, end := "[", ",", "]"
+	if w.format == fs.FormatJSONL {
+		open, sep, end = "", "\n", "\n"
+	}
+	buf := make([]byte, 0, 4096)
+	if _, err := writer.Write([]byte(open)); err != nil {
+		return err
+	}
+	for i, txid := range txids {
+		s, ok := w.spans[txid]
+		if !ok {
+			return errors.New(fmt.Sprintf("tx %s not downloaded", txid))
+		}
+		if cap(buf) < s.length {
+			buf = make([]byte, s.length)
+		}
+		buf = buf[:s.length]
+		if _, err := w.part.ReadAt(buf, s.offset); err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := writer.Write([]byte(sep)); err != nil {
+				return err
+			}
+		}
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+	}
+	_, err := writer.Write([]byte(end))
+	return err
+}
+
+// Close keeps part file for resuming later.
+func (w *BlockWriter) Close() error {
+	return w.part.Close()
+}
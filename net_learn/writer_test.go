@@ -0,0 +1,163 @@
+package net_learn
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kevin2li/go_learn/chain"
+	fs "github.com/kevin2li/go_learn/file"
+)
+
+func writerTxs(txids ...string) []chain.Transaction {
+	txs := make([]chain.Transaction, len(txids))
+	for i, txid := range txids {
+		txs[i].Txid = txid
+		txs[i].Size = uint(100 + i)
+	}
+	return txs
+}
+
+// txids saved in the block file at path, in file order
+func savedTxids(t *testing.T, path string) []string {
+	t.Helper()
+	content, err := fs.ReadBlock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txs []chain.Transaction
+	if err := json.Unmarshal(content, &txs); err != nil {
+		t.Fatalf("unmarshal %s: %v", path, err)
+	}
+	var txids []string
+	for _, tx := range txs {
+		txids = append(txids, tx.Txid)
+	}
+	return txids
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBlockWriterCommit(t *testing.T) {
+	block := []string{"a", "b", "c", "d"}
+	for _, format := range []string{fs.FormatJSON, fs.FormatJSONL} {
+		for _, compress := range []string{fs.CompressNone, fs.CompressGzip, fs.CompressZstd} {
+			ext, err := fs.BlockExt(format, compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "block_height=1"+ext)
+			w, err := OpenBlockWriter(path, format, compress, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// pages arrive out of block order
+			if err := w.WritePage(writerTxs("c", "d")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.WritePage(writerTxs("a", "b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Commit(block); err != nil {
+				t.Fatalf("%s %s: %v", format, compress, err)
+			}
+			if got := savedTxids(t, path); !equalStrings(got, block) {
+				t.Errorf("%s %s: saved %v, want %v", format, compress, got, block)
+			}
+			for _, suffix := range []string{partSuffix, tmpSuffix} {
+				if _, err := os.Stat(path + suffix); !os.IsNotExist(err) {
+					t.Errorf("%s %s: %s left after commit", format, compress, suffix)
+				}
+			}
+		}
+	}
+}
+
+func TestBlockWriterResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block_height=1.json")
+	w, err := OpenBlockWriter(path, fs.FormatJSON, fs.CompressNone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePage(writerTxs("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	// a crash in the middle of the next page
+	part, err := os.OpenFile(path+partSuffix, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.WriteString(`{"txid":"c","size":1`)
+	part.Close()
+
+	w, err = OpenBlockWriter(path, fs.FormatJSON, fs.CompressNone, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Count() != 2 || !w.Has("a") || !w.Has("b") || w.Has("c") {
+		t.Fatalf("resumed %d txs, want a and b without the half written c", w.Count())
+	}
+	if err := w.WritePage(writerTxs("c")); err != nil {
+		t.Fatal(err)
+	}
+	// a tx not downloaded fails the commit and keeps the part file
+	if err := w.Commit([]string{"a", "b", "c", "d"}); err == nil {
+		t.Fatal("commit of a block missing tx d succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("block file saved without tx d")
+	}
+	if err := w.WritePage(writerTxs("d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit([]string{"a", "b", "c", "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := savedTxids(t, path); !equalStrings(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("saved %v, want a b c d", got)
+	}
+	content, err := fs.ReadBlock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txs []chain.Transaction
+	if err := json.Unmarshal(content, &txs); err != nil {
+		t.Fatal(err)
+	}
+	if txs[2].Size != 100 {
+		t.Errorf("tx c has size %d, want 100 written after resume", txs[2].Size)
+	}
+}
+
+func TestBlockWriterNoResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block_height=1.json")
+	w, err := OpenBlockWriter(path, fs.FormatJSON, fs.CompressNone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePage(writerTxs("a")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w, err = OpenBlockWriter(path, fs.FormatJSON, fs.CompressNone, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Count() != 0 {
+		t.Fatalf("part file kept %d txs without resume", w.Count())
+	}
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// log levels, a log line is of the level named by the prefix its message
+// starts with, like `WARN: `. Lines without one always pass, log.Fatal and
+// plain log.Println output have none.
+var levels = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+type levelWriter struct {
+	w      io.Writer
+	min    int
+	flags  int    // flags of the logger, to find where the message starts
+	prefix string // prefix of the logger
+}
+
+// message returns line without the date, time, file and prefix the log
+// package writes before the message
+func (lw *levelWriter) message(line []byte) []byte {
+	if lw.flags&log.Lmsgprefix == 0 {
+		line = bytes.TrimPrefix(line, []byte(lw.prefix))
+	}
+	skip := 0
+	if lw.flags&log.Ldate != 0 {
+		skip += len("2009/01/23 ")
+	}
+	if lw.flags&log.Lmicroseconds != 0 {
+		skip += len("01:23:23.123123 ")
+	} else if lw.flags&log.Ltime != 0 {
+		skip += len("01:23:23 ")
+	}
+	if skip > len(line) {
+		return nil
+	}
+	line = line[skip:]
+	if lw.flags&(log.Lshortfile|log.Llongfile) != 0 {
+		if i := bytes.Index(line, []byte(": ")); i >= 0 {
+			line = line[i+2:]
+		}
+	}
+	if lw.flags&log.Lmsgprefix != 0 {
+		line = bytes.TrimPrefix(line, []byte(lw.prefix))
+	}
+	return line
+}
+
+// lineLevel returns the level msg starts with, -1 if none
+func lineLevel(msg []byte) int {
+	for i, level := range levels {
+		if bytes.HasPrefix(msg, []byte(level+":")) {
+			return i
+		}
+	}
+	return -1
+}
+
+// log writes each line with a single Write
+func (lw *levelWriter) Write(p []byte) (int, error) {
+	if level := lineLevel(lw.message(p)); level >= 0 && level < lw.min {
+		return len(p), nil
+	}
+	return lw.w.Write(p)
+}
+
+// SetLogLevel drops lines of the log package below level: debug, info,
+// warn or error. Flags and prefix of the log package should be set before.
+func SetLogLevel(level string) error {
+	for i, name := range levels {
+		if strings.EqualFold(level, name) {
+			log.SetOutput(&levelWriter{w: os.Stderr, min: i, flags: log.Flags(), prefix: log.Prefix()})
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("unknown log level `%s`, should be debug, info, warn or error", level))
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestLevelWriter(t *testing.T) {
+	for _, flags := range []int{0, log.LstdFlags, log.LstdFlags | log.Lmicroseconds | log.Lshortfile} {
+		var buf bytes.Buffer
+		logger := log.New(&levelWriter{w: &buf, min: 2, flags: flags, prefix: "crawler "}, "crawler ", flags)
+		logger.Println("DEBUG: dropped")
+		logger.Println("INFO: dropped")
+		logger.Println("INFO: tx paid ERROR: 1 BTC, dropped")
+		logger.Println("WARN: kept")
+		logger.Println("ERROR: kept")
+		logger.Println("no level, kept")
+		logger.Println("fatal error: kept")
+		logger.Println("see WARN: later, kept")
+		out := buf.String()
+		for _, msg := range []string{"dropped", "WARN: kept", "ERROR: kept", "no level, kept", "fatal error: kept", "see WARN: later, kept"} {
+			if got, want := bytes.Contains([]byte(out), []byte(msg)), msg != "dropped"; got != want {
+				t.Errorf("flags %d: %q written = %v, want %v\n%s", flags, msg, got, want, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	pb "github.com/schollz/progressbar/v3"
+)
+
+func GetProgressBar(max int) *pb.ProgressBar {
+	bar := pb.NewOptions(max,
+		// pb.OptionSetWriter(ansi.NewAnsiStdout()),
+		pb.OptionEnableColorCodes(true),
+		pb.OptionShowBytes(true),
+		pb.OptionSetWidth(40),
+		pb.OptionShowCount(),
+		pb.OptionThrottle(65*time.Millisecond),
+		pb.OptionOnCompletion(func() {
+			fmt.Fprint(os.Stderr, "\n")
+		}),
+		pb.OptionSetTheme(pb.Theme{
+			Saucer:        "[green]=[reset]",
+			SaucerHead:    "[green]>[reset]",
+			SaucerPadding: " ",
+			BarStart:      "[",
+			BarEnd:        "]",
+		}))
+	return bar
+}